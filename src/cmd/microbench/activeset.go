@@ -0,0 +1,179 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// activeSet is a set of the active nodes of a simulation. A node is given by its id,
+// its index in the graph, and its label, each set keys the nodes by one of them. The
+// engine keeps the actives in a map by label, Run.Actives.
+type activeSet interface {
+	Add(id int, label string)
+	Has(id int, label string) bool
+}
+
+// mapSet is the set of the engine, a map by label.
+type mapSet map[string]int
+
+func (s mapSet) Add(id int, label string) {
+	s[label] = id
+}
+
+func (s mapSet) Has(id int, label string) bool {
+	_, ok := s[label]
+	return ok
+}
+
+// sortedSet keeps the ids in a sorted slice, inserting in place.
+type sortedSet struct {
+	ids []int
+}
+
+func (s *sortedSet) Add(id int, label string) {
+	i := sort.SearchInts(s.ids, id)
+	if i < len(s.ids) && s.ids[i] == id {
+		return
+	}
+	s.ids = append(s.ids, 0)
+	copy(s.ids[i+1:], s.ids[i:])
+	s.ids[i] = id
+}
+
+func (s *sortedSet) Has(id int, label string) bool {
+	i := sort.SearchInts(s.ids, id)
+	return i < len(s.ids) && s.ids[i] == id
+}
+
+// bitSet keeps a bit for each id of the graph.
+type bitSet []uint64
+
+func newBitSet(size int) bitSet {
+	return make(bitSet, (size+63)/64)
+}
+
+func (s bitSet) Add(id int, label string) {
+	s[id/64] |= 1 << uint(id%64)
+}
+
+func (s bitSet) Has(id int, label string) bool {
+	return s[id/64]&(1<<uint(id%64)) != 0
+}
+
+// syncMapSet is a sync.Map by label, safe to share between the workers of an engine.
+type syncMapSet struct {
+	m sync.Map
+}
+
+func (s *syncMapSet) Add(id int, label string) {
+	s.m.Store(label, id)
+}
+
+func (s *syncMapSet) Has(id int, label string) bool {
+	_, ok := s.m.Load(label)
+	return ok
+}
+
+// setShards is the number of shards of a shardedSet.
+const setShards = 32
+
+// shardedSet splits the labels over maps each locked by its own mutex, so that
+// workers adding different labels rarely wait for each other.
+type shardedSet struct {
+	shards [setShards]struct {
+		sync.Mutex
+		m map[string]int
+	}
+}
+
+func newShardedSet() *shardedSet {
+	s := new(shardedSet)
+	for i := range s.shards {
+		s.shards[i].m = make(map[string]int)
+	}
+	return s
+}
+
+// shard returns the shard of the label by its FNV-1a hash.
+func (s *shardedSet) shard(label string) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(label); i++ {
+		h ^= uint32(label[i])
+		h *= 16777619
+	}
+	return int(h % setShards)
+}
+
+func (s *shardedSet) Add(id int, label string) {
+	shard := &s.shards[s.shard(label)]
+	shard.Lock()
+	shard.m[label] = id
+	shard.Unlock()
+}
+
+func (s *shardedSet) Has(id int, label string) bool {
+	shard := &s.shards[s.shard(label)]
+	shard.Lock()
+	_, ok := shard.m[label]
+	shard.Unlock()
+	return ok
+}
+
+// activeSets are the sets benchmarked, each created for a graph of size nodes.
+var activeSets = []struct {
+	name string
+	new  func(size int) activeSet
+}{
+	{"map", func(int) activeSet { return make(mapSet) }},
+	{"sorted-slice", func(int) activeSet { return new(sortedSet) }},
+	{"bitset", func(size int) activeSet { return newBitSet(size) }},
+	{"sync-map", func(int) activeSet { return new(syncMapSet) }},
+	{"sharded-map", func(int) activeSet { return newShardedSet() }},
+}
+
+// activeSetBenchmarks benchmarks the sets on graphs of each size:
+//
+//	add  activating every node twice in a random order, checking if it is active
+//	     first as the engine does, from an empty set
+//	has  checking if each node is active in a set of half of the nodes
+func activeSetBenchmarks(sizes []int) []benchmark {
+	var benchmarks []benchmark
+	for _, size := range sizes {
+		labels := GenerateDataSet(size)
+		r := rand.New(rand.NewSource(1))
+		// Nodes are reached from several parents, each is activated twice.
+		order := append(r.Perm(size), r.Perm(size)...)
+		for _, set := range activeSets {
+			newSet := set.new
+			size := size
+			benchmarks = append(benchmarks, benchmark{set.name + "/add", size, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					s := newSet(size)
+					for _, id := range order {
+						if !s.Has(id, labels[id].Label) {
+							s.Add(id, labels[id].Label)
+						}
+					}
+				}
+			}})
+		}
+		for _, set := range activeSets {
+			s := set.new(size)
+			for _, id := range order[:size/2] {
+				s.Add(id, labels[id].Label)
+			}
+			benchmarks = append(benchmarks, benchmark{set.name + "/has", size, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for id := range labels {
+						if s.Has(id, labels[id].Label) {
+							sink++
+						}
+					}
+				}
+			}})
+		}
+	}
+	return benchmarks
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// randomEdges returns the children of each node of a random graph of size nodes
+// reachable from the first, with degree children per node on average. Each node but
+// the first is a child of an earlier node, the other edges are between any nodes.
+func randomEdges(size, degree int, seed int64) [][]int {
+	r := rand.New(rand.NewSource(seed))
+	edges := make([][]int, size)
+	for i := 1; i < size; i++ {
+		parent := r.Intn(i)
+		edges[parent] = append(edges[parent], i)
+	}
+	for i := size - 1; i < size*degree; i++ {
+		from := r.Intn(size)
+		edges[from] = append(edges[from], r.Intn(size))
+	}
+	return edges
+}
+
+// layout is a layout of the adjacency of a graph in memory.
+type layout interface {
+	// walk visits the nodes reachable from the first node breadth first, marking them
+	// in visited, and returns the number of edges followed.
+	walk(visited []bool) int
+}
+
+// pointerGraph links the nodes to their children by pointers.
+type pointerGraph struct {
+	nodes []*pointerNode
+	queue []*pointerNode
+}
+
+type pointerNode struct {
+	Id       int
+	Children []*pointerNode
+}
+
+func newPointerGraph(edges [][]int) layout {
+	g := &pointerGraph{nodes: make([]*pointerNode, len(edges))}
+	for i := range edges {
+		g.nodes[i] = &pointerNode{Id: i}
+	}
+	for i, children := range edges {
+		for _, child := range children {
+			g.nodes[i].Children = append(g.nodes[i].Children, g.nodes[child])
+		}
+	}
+	return g
+}
+
+func (g *pointerGraph) walk(visited []bool) int {
+	followed := 0
+	g.queue = append(g.queue[:0], g.nodes[0])
+	visited[0] = true
+	for i := 0; i < len(g.queue); i++ {
+		for _, child := range g.queue[i].Children {
+			followed++
+			if !visited[child.Id] {
+				visited[child.Id] = true
+				g.queue = append(g.queue, child)
+			}
+		}
+	}
+	return followed
+}
+
+// indexGraph gives the children of the nodes by their index in the graph, as
+// LabelNode does.
+type indexGraph struct {
+	nodes []*indexNode
+	queue []int
+}
+
+type indexNode struct {
+	Id       int
+	Children []int
+}
+
+func newIndexGraph(edges [][]int) layout {
+	g := &indexGraph{nodes: make([]*indexNode, len(edges))}
+	for i, children := range edges {
+		g.nodes[i] = &indexNode{Id: i, Children: append([]int(nil), children...)}
+	}
+	return g
+}
+
+func (g *indexGraph) walk(visited []bool) int {
+	followed := 0
+	g.queue = append(g.queue[:0], 0)
+	visited[0] = true
+	for i := 0; i < len(g.queue); i++ {
+		for _, child := range g.nodes[g.queue[i]].Children {
+			followed++
+			if !visited[child] {
+				visited[child] = true
+				g.queue = append(g.queue, child)
+			}
+		}
+	}
+	return followed
+}
+
+// csrGraph is the compressed sparse row layout: the children of all the nodes in
+// one slice, those of node i from offsets[i] to offsets[i+1].
+type csrGraph struct {
+	offsets  []int32
+	children []int32
+	queue    []int32
+}
+
+func newCSRGraph(edges [][]int) layout {
+	g := &csrGraph{offsets: make([]int32, len(edges)+1)}
+	for i, children := range edges {
+		g.offsets[i+1] = g.offsets[i] + int32(len(children))
+	}
+	g.children = make([]int32, 0, g.offsets[len(edges)])
+	for _, children := range edges {
+		for _, child := range children {
+			g.children = append(g.children, int32(child))
+		}
+	}
+	return g
+}
+
+func (g *csrGraph) walk(visited []bool) int {
+	followed := 0
+	g.queue = append(g.queue[:0], 0)
+	visited[0] = true
+	for i := 0; i < len(g.queue); i++ {
+		node := g.queue[i]
+		for _, child := range g.children[g.offsets[node]:g.offsets[node+1]] {
+			followed++
+			if !visited[child] {
+				visited[child] = true
+				g.queue = append(g.queue, child)
+			}
+		}
+	}
+	return followed
+}
+
+// layouts are the adjacency layouts benchmarked.
+var layouts = []struct {
+	name  string
+	build func(edges [][]int) layout
+}{
+	{"pointers", newPointerGraph},
+	{"index-slices", newIndexGraph},
+	{"csr", newCSRGraph},
+}
+
+// adjacencyBenchmarks benchmarks the layouts on random graphs of each size with 4
+// children per node on average:
+//
+//	build  building the layout from the children of the nodes
+//	walk   a breadth first walk of the graph, reusing the queue and visited marks
+func adjacencyBenchmarks(sizes []int) []benchmark {
+	var benchmarks []benchmark
+	for _, size := range sizes {
+		edges := randomEdges(size, 4, 1)
+		for _, l := range layouts {
+			build := l.build
+			benchmarks = append(benchmarks, benchmark{l.name + "/build", size, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					build(edges)
+				}
+			}})
+		}
+		for _, l := range layouts {
+			g := l.build(edges)
+			visited := make([]bool, size)
+			benchmarks = append(benchmarks, benchmark{l.name + "/walk", size, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					for j := range visited {
+						visited[j] = false
+					}
+					sink += g.walk(visited)
+				}
+			}})
+		}
+	}
+	return benchmarks
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"text/tabwriter"
+	"time"
+)
+
+// benchmark is a benchmark of a structure on a number of nodes, run through
+// testing.Benchmark.
+type benchmark struct {
+	Name string
+	Size int
+	F    func(b *testing.B)
+}
+
+// sink keeps the results of the benchmarks alive so the compiler does not remove
+// the work measured.
+var sink int
+
+// benchmarkFlags are the flags of the commands running benchmarks.
+var benchmarkFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "sizes, s",
+		Value: "100,1000,10000",
+		Usage: "Comma separated numbers of nodes of the structures.",
+	},
+	cli.DurationFlag{
+		Name:  "benchtime",
+		Value: time.Second,
+		Usage: "The time each benchmark is run for, as with go test -benchtime.",
+	},
+}
+
+// benchmarkSizes parses the sizes and sets the run time of the benchmarks from the
+// flags of the command.
+func benchmarkSizes(c *cli.Context) []int {
+	sizes, err := parseInts(c.String("sizes"))
+	if err != nil {
+		log.Fatalf("%s: %v", c.Command.Name, err)
+	}
+	// testing.Benchmark reads its run time from the flags of go test.
+	testing.Init()
+	if err := flag.Set("test.benchtime", c.Duration("benchtime").String()); err != nil {
+		log.Fatal(err)
+	}
+	return sizes
+}
+
+// parseInts parses a comma separated list of positive integers, such as 1,2,4,8.
+func parseInts(list string) ([]int, error) {
+	var ints []int
+	for _, s := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("%q is not a list of positive integers", list)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// runBenchmarks runs the benchmarks and prints their time and allocations per
+// operation, and the time per node of the operation.
+func runBenchmarks(benchmarks []benchmark) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Benchmark\tSize\tRuns\tns/op\tns/node\tB/op\tallocs/op\t")
+	for _, bm := range benchmarks {
+		f := bm.F
+		r := testing.Benchmark(func(b *testing.B) {
+			b.ReportAllocs()
+			f(b)
+		})
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.1f\t%d\t%d\t\n", bm.Name, bm.Size, r.N, r.NsPerOp(),
+			float64(r.NsPerOp())/float64(bm.Size), r.AllocedBytesPerOp(), r.AllocsPerOp())
+	}
+	w.Flush()
+}
@@ -21,7 +21,7 @@ func sortedArrayToBST(a []Data) *Tree {
 
 func (a *Tree) Get(x string) Data {
 	root := a
-	for root.Value.Label != x && root != nil {
+	for root != nil && root.Value.Label != x {
 		if x > root.Value.Label {
 			root = root.Right
 		} else {
@@ -35,3 +35,100 @@ func (a *Tree) Get(x string) Data {
 	}
 
 }
+
+// AVLTree is a binary search tree kept balanced by rotations as data is inserted,
+// where the Tree of sortedArrayToBST is built once from all the data.
+type AVLTree struct {
+	root *avlNode
+}
+
+type avlNode struct {
+	Left   *avlNode
+	Value  Data
+	Right  *avlNode
+	height int
+}
+
+func (a *AVLTree) Insert(x Data) {
+	a.root = insertAVL(a.root, x)
+}
+
+func (a *AVLTree) Get(x string) Data {
+	root := a.root
+	for root != nil && root.Value.Label != x {
+		if x > root.Value.Label {
+			root = root.Right
+		} else {
+			root = root.Left
+		}
+	}
+	if root != nil {
+		return root.Value
+	}
+	return Data{}
+}
+
+func insertAVL(n *avlNode, x Data) *avlNode {
+	if n == nil {
+		return &avlNode{Value: x, height: 1}
+	}
+	switch {
+	case x.Label < n.Value.Label:
+		n.Left = insertAVL(n.Left, x)
+	case x.Label > n.Value.Label:
+		n.Right = insertAVL(n.Right, x)
+	default:
+		n.Value = x
+		return n
+	}
+	return balanceAVL(n)
+}
+
+func avlHeight(n *avlNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+func (n *avlNode) updateHeight() {
+	n.height = avlHeight(n.Left) + 1
+	if h := avlHeight(n.Right) + 1; h > n.height {
+		n.height = h
+	}
+}
+
+// balanceAVL restores the balance of a node whose subtrees differ in height by at
+// most 2 after an insert, returning the root of the subtree.
+func balanceAVL(n *avlNode) *avlNode {
+	n.updateHeight()
+	switch diff := avlHeight(n.Left) - avlHeight(n.Right); {
+	case diff > 1:
+		if avlHeight(n.Left.Left) < avlHeight(n.Left.Right) {
+			n.Left = rotateLeft(n.Left)
+		}
+		return rotateRight(n)
+	case diff < -1:
+		if avlHeight(n.Right.Right) < avlHeight(n.Right.Left) {
+			n.Right = rotateRight(n.Right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+func rotateRight(n *avlNode) *avlNode {
+	l := n.Left
+	n.Left, l.Right = l.Right, n
+	n.updateHeight()
+	l.updateHeight()
+	return l
+}
+
+func rotateLeft(n *avlNode) *avlNode {
+	r := n.Right
+	n.Right, r.Left = r.Left, n
+	n.updateHeight()
+	r.updateHeight()
+	return r
+}
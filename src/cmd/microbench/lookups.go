@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+)
+
+// lookupKeys returns n labels to look up in the data, of which a ratio of hits are
+// labels of the data and the others labels of absent. The labels are drawn from
+// either with a distribution: uniform, or zipf where the i-th most looked up label
+// is looked up about 1/i^s as often as the first. The most looked up labels are
+// spread over the data rather than the smallest labels.
+func lookupKeys(data, absent []Data, n int, hits float64, distribution string, s float64, seed int64) ([]string, error) {
+	r := rand.New(rand.NewSource(seed))
+	pick := func(labels []Data) func() string {
+		order := r.Perm(len(labels))
+		switch distribution {
+		case "uniform":
+			return func() string { return labels[order[r.Intn(len(labels))]].Label }
+		case "zipf":
+			z := rand.NewZipf(r, s, 1, uint64(len(labels)-1))
+			return func() string { return labels[order[z.Uint64()]].Label }
+		}
+		return nil
+	}
+	if distribution != "uniform" && distribution != "zipf" {
+		return nil, fmt.Errorf("unknown distribution %q, use uniform or zipf", distribution)
+	}
+	if distribution == "zipf" && s <= 1 {
+		return nil, fmt.Errorf("the exponent of the zipf distribution must be larger than 1")
+	}
+	if hits < 0 || hits > 1 {
+		return nil, fmt.Errorf("the ratio of hits must be between 0 and 1")
+	}
+	hit, miss := pick(data), pick(absent)
+	keys := make([]string, n)
+	for i := range keys {
+		if r.Float64() < hits {
+			keys[i] = hit()
+		} else {
+			keys[i] = miss()
+		}
+	}
+	return keys, nil
+}
+
+// studentT are the two sided 95% quantiles of the t distribution by degrees of
+// freedom, from 1 to 30.
+var studentT = []float64{
+	12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+	2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+	2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042,
+}
+
+// confidenceInterval returns the mean of the samples and the half width of its 95%
+// confidence interval, from the t distribution. The width is 0 for a single sample.
+func confidenceInterval(samples []float64) (float64, float64) {
+	n := len(samples)
+	mean := 0.0
+	for _, x := range samples {
+		mean += x
+	}
+	mean /= float64(n)
+	if n < 2 {
+		return mean, 0
+	}
+	variance := 0.0
+	for _, x := range samples {
+		variance += (x - mean) * (x - mean)
+	}
+	variance /= float64(n - 1)
+	t := 1.96
+	if n-1 <= len(studentT) {
+		t = studentT[n-2]
+	}
+	return mean, t * math.Sqrt(variance/float64(n))
+}
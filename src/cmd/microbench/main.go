@@ -4,7 +4,11 @@ import (
 	"fmt"
 	"github.com/codegangsta/cli"
 	//"github.com/davecgh/go-spew/spew"
+	"log"
+	"math/rand"
 	"os"
+	"runtime"
+	"text/tabwriter"
 	"time"
 )
 
@@ -16,67 +20,245 @@ func main() {
 
 	app.Commands = []cli.Command{
 		cli.Command{
-			Name:        "map",
-			Usage:       "Run a micro benchmark testing maps vs binary search trees",
-			Description: "A Micro benchmark testing the performance difference between maps and BST for existance of value",
+			Name:  "map",
+			Usage: "Run a micro benchmark testing maps vs binary search trees",
+			Description: `A Micro benchmark testing the performance difference between maps and BST for existance of value.
+   Compares a map, a BST built once from the sorted sample and an AVL tree built by inserts, looking up labels of the
+   sample and absent labels in a ratio, drawn uniformly or from a zipf distribution. Prints the mean time per lookup and
+   per insert over the trials with its 95% confidence interval.`,
 			Flags: []cli.Flag{
 				cli.IntFlag{
 					Name:  "size, s",
 					Value: 100,
 					Usage: "Size of the sample to be tested.",
 				},
+				cli.IntFlag{
+					Name:  "lookups, l",
+					Value: 100000,
+					Usage: "The number of lookups timed in each trial.",
+				},
+				cli.Float64Flag{
+					Name:  "hits",
+					Value: 1,
+					Usage: "The ratio of the lookups of labels in the sample, the others are of absent labels.",
+				},
+				cli.StringFlag{
+					Name:  "distribution",
+					Value: "uniform",
+					Usage: "The distribution of the labels looked up: uniform or zipf.",
+				},
+				cli.Float64Flag{
+					Name:  "zipf",
+					Value: 1.1,
+					Usage: "The exponent of the zipf distribution, larger than 1.",
+				},
+				cli.IntFlag{
+					Name:  "trials, t",
+					Value: 10,
+					Usage: "The number of timed trials.",
+				},
+				cli.IntFlag{
+					Name:  "warmup",
+					Value: 2,
+					Usage: "The number of untimed trials run before the timed trials.",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Value: 100,
+					Usage: "The seed of the random generator of the lookups and insert orders.",
+				},
 			},
 			Action: MapVsTreeBenchmark,
 		},
+		cli.Command{
+			Name:  "actives",
+			Usage: "Run benchmarks of the representations of the set of active nodes",
+			Description: `Benchmarks a map by label as in the engine, a sorted slice of ids, a bitset of ids, a sync.Map by label and
+   a map by label sharded over mutexes, adding the nodes as they are activated and checking if nodes are active.
+   The shared sets are run from a single goroutine, measuring the cost of their synchronization.`,
+			Flags:  benchmarkFlags,
+			Action: ActiveSetBenchmark,
+		},
+		cli.Command{
+			Name:  "adjacency",
+			Usage: "Run benchmarks of the layouts of the children of the nodes",
+			Description: `Benchmarks nodes linked by pointers, nodes with the indexes of their children as in LabelNode and the
+   compressed sparse row layout, building them and walking the graph breadth first.`,
+			Flags:  benchmarkFlags,
+			Action: AdjacencyBenchmark,
+		},
+		cli.Command{
+			Name:  "queue",
+			Usage: "Run benchmarks of the queues of nodes",
+			Description: `Benchmarks a slice queue as the Queue of the generators, a ring buffer and a buffered channel, filling and
+   draining them and using them as the growing frontier of a walk.`,
+			Flags:  benchmarkFlags,
+			Action: QueueBenchmark,
+		},
+		cli.Command{
+			Name:  "transport",
+			Usage: "Run benchmarks of channels against the mpmc queue between goroutines",
+			Description: `Benchmarks sending the nodes from producer goroutines to consumer goroutines over a buffered channel, as
+   the concurrent engine does, and over the lock free queue of the concurrent-ring engine, with each buffer size as
+   set by the --buffer flag of the engines, and each number of producers and consumers. The goroutines are started for
+   each operation. A buffer of 0 is rejected: the channel would be unbuffered while the queue has at least 2 slots,
+   and the queue rounds the other sizes up to a power of 2, so the sizes only match for powers of 2.`,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "buffers, b",
+					Value: "16,1024",
+					Usage: "Comma separated buffer sizes of the channels and queues, at least 1. The queues round them up to a power of 2.",
+				},
+				cli.StringFlag{
+					Name:  "producers, p",
+					Value: "1,4",
+					Usage: "Comma separated numbers of producer goroutines.",
+				},
+				cli.StringFlag{
+					Name:  "consumers, c",
+					Value: "1,4",
+					Usage: "Comma separated numbers of consumer goroutines.",
+				},
+			}, benchmarkFlags...),
+			Action: TransportBenchmark,
+		},
 	}
 
 	app.Run(os.Args)
 }
 
-func MapVsTreeBenchmark(c *cli.Context) {
-	size := c.Int("size")
-
-	sample := GenerateDataSet(size)
-
-	sortedSample := SortData(sample)
-
-	testValues := GetRandomFromDataSet(sortedSample, size/10, 100)
+// lookupStructure is a structure looked up by the map benchmark, built from the data
+// in a random order.
+type lookupStructure struct {
+	name  string
+	build func(data []Data) func(label string) Data
+	// inserts is set if the structure is built by inserting the data one at a time,
+	// which is timed.
+	inserts bool
+}
 
-	mapTest := make(map[string]Data)
+var lookupStructures = []lookupStructure{
+	{"map", func(data []Data) func(string) Data {
+		m := make(map[string]Data)
+		for i := range data {
+			m[data[i].Label] = data[i]
+		}
+		return func(label string) Data { return m[label] }
+	}, true},
+	{"sorted-bst", func(data []Data) func(string) Data {
+		sorted := SortData(append(DataList(nil), data...))
+		return sortedArrayToBST(sorted).Get
+	}, false},
+	{"avl-tree", func(data []Data) func(string) Data {
+		t := new(AVLTree)
+		for i := range data {
+			t.Insert(data[i])
+		}
+		return t.Get
+	}, true},
+}
 
-	// Insertion to map
-	for i := range sortedSample {
-		mapTest[sortedSample[i].Label] = sortedSample[i]
+func MapVsTreeBenchmark(c *cli.Context) {
+	size, lookups := c.Int("size"), c.Int("lookups")
+	trials, warmup := c.Int("trials"), c.Int("warmup")
+	if size < 1 || lookups < 1 || trials < 1 || warmup < 0 {
+		log.Fatal("map: size, lookups and trials must be at least 1")
 	}
 
-	// Insertion to BST
-	bstTest := sortedArrayToBST(sortedSample)
-
-	var mapTestValues, treeTestValues []Data
+	sample := GenerateDataSet(size)
+	absent := GenerateDataSet(size)
+	keys, err := lookupKeys(sample, absent, lookups, c.Float64("hits"), c.String("distribution"), c.Float64("zipf"), int64(c.Int("seed")))
+	if err != nil {
+		log.Fatalf("map: %v", err)
+	}
+	present := make(map[string]bool)
+	for i := range sample {
+		present[sample[i].Label] = true
+	}
 
-	startMap := time.Now()
+	// The samples are in ns per lookup or per insert.
+	lookupTimes := make([][]float64, len(lookupStructures))
+	insertTimes := make([][]float64, len(lookupStructures))
+	incorrect := make([]bool, len(lookupStructures))
+	r := rand.New(rand.NewSource(int64(c.Int("seed"))))
+	for trial := 0; trial < warmup+trials; trial++ {
+		// Each trial builds the structures from the data in another order.
+		for i, j := range r.Perm(len(sample)) {
+			sample[i], sample[j] = sample[j], sample[i]
+		}
+		for i, s := range lookupStructures {
+			runtime.GC()
+			start := time.Now()
+			get := s.build(sample)
+			insert := time.Since(start)
 
-	for i := range testValues {
-		mapTestValues = append(mapTestValues, mapTest[testValues[i].Label])
-	}
-	endMap := time.Since(startMap)
+			start = time.Now()
+			for _, key := range keys {
+				sink += len(get(key).Label)
+			}
+			lookup := time.Since(start)
 
-	startTree := time.Now()
-	for i := range testValues {
-		treeTestValues = append(treeTestValues, bstTest.Get(testValues[i].Label))
+			if trial == 0 {
+				for _, key := range keys {
+					if v := get(key); present[key] != (v.Label == key) {
+						incorrect[i] = true
+					}
+				}
+			}
+			if trial < warmup {
+				continue
+			}
+			lookupTimes[i] = append(lookupTimes[i], float64(lookup.Nanoseconds())/float64(len(keys)))
+			insertTimes[i] = append(insertTimes[i], float64(insert.Nanoseconds())/float64(size))
+		}
 	}
-	endTree := time.Since(startTree)
 
-	for i := range mapTestValues {
-		if mapTestValues[i].Label != testValues[i].Label {
-			fmt.Println("MapTest is incorrect")
+	fmt.Printf("Size: %d\nLookups: %d\nHits: %g\nDistribution: %s\nTrials: %d\nWarm-up: %d\n",
+		size, lookups, c.Float64("hits"), c.String("distribution"), trials, warmup)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Structure\tOperation\tns/op\t95% CI\t")
+	for _, op := range []string{"lookup", "insert"} {
+		for i, s := range lookupStructures {
+			samples := lookupTimes[i]
+			if op == "insert" {
+				if !s.inserts {
+					continue
+				}
+				samples = insertTimes[i]
+			}
+			mean, half := confidenceInterval(samples)
+			fmt.Fprintf(w, "%s\t%s\t%.1f\t± %.1f\t\n", s.name, op, mean, half)
 		}
 	}
-	for i := range treeTestValues {
-		if treeTestValues[i].Label != testValues[i].Label {
-			fmt.Println("treeTest is incorrect")
+	w.Flush()
+	for i, s := range lookupStructures {
+		if incorrect[i] {
+			fmt.Printf("%s is incorrect\n", s.name)
 		}
 	}
+}
+
+func ActiveSetBenchmark(c *cli.Context) {
+	runBenchmarks(activeSetBenchmarks(benchmarkSizes(c)))
+}
 
-	fmt.Printf("Map: %s\nTree: %s\n", endMap, endTree)
+func AdjacencyBenchmark(c *cli.Context) {
+	runBenchmarks(adjacencyBenchmarks(benchmarkSizes(c)))
+}
+
+func QueueBenchmark(c *cli.Context) {
+	runBenchmarks(queueBenchmarks(benchmarkSizes(c)))
+}
+
+func TransportBenchmark(c *cli.Context) {
+	sizes := benchmarkSizes(c)
+	var lists [3][]int
+	for i, flag := range []string{"buffers", "producers", "consumers"} {
+		list, err := parseInts(c.String(flag))
+		if err != nil {
+			log.Fatalf("transport: %v", err)
+		}
+		lists[i] = list
+	}
+	runBenchmarks(transportBenchmarks(sizes, lists[0], lists[1], lists[2]))
 }
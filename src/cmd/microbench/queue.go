@@ -0,0 +1,132 @@
+package main
+
+import "testing"
+
+// queue is a FIFO queue of the ids of nodes, such as the frontier of a breadth first
+// walk.
+type queue interface {
+	Enqueue(id int)
+	Dequeue() (int, bool)
+}
+
+// sliceQueue is the Queue of the graph generators: it appends to a slice and
+// dequeues by reslicing, so the memory of the dequeued ids is only reused once the
+// slice is grown.
+type sliceQueue struct {
+	V []int
+}
+
+func (q *sliceQueue) Enqueue(id int) {
+	q.V = append(q.V, id)
+}
+
+func (q *sliceQueue) Dequeue() (int, bool) {
+	if len(q.V) < 1 {
+		return 0, false
+	}
+	id := q.V[0]
+	q.V = q.V[1:]
+	return id, true
+}
+
+// ringQueue is a ring buffer doubled when full.
+type ringQueue struct {
+	buf  []int
+	head int
+	n    int
+}
+
+func (q *ringQueue) Enqueue(id int) {
+	if q.n == len(q.buf) {
+		size := 2 * len(q.buf)
+		if size == 0 {
+			size = 16
+		}
+		buf := make([]int, size)
+		n := copy(buf, q.buf[q.head:])
+		copy(buf[n:], q.buf[:q.head])
+		q.buf, q.head = buf, 0
+	}
+	q.buf[(q.head+q.n)%len(q.buf)] = id
+	q.n++
+}
+
+func (q *ringQueue) Dequeue() (int, bool) {
+	if q.n == 0 {
+		return 0, false
+	}
+	id := q.buf[q.head]
+	q.head = (q.head + 1) % len(q.buf)
+	q.n--
+	return id, true
+}
+
+// chanQueue is a buffered channel, which has to be made with the capacity of the
+// most ids queued at once.
+type chanQueue chan int
+
+func (q chanQueue) Enqueue(id int) {
+	q <- id
+}
+
+func (q chanQueue) Dequeue() (int, bool) {
+	select {
+	case id := <-q:
+		return id, true
+	default:
+		return 0, false
+	}
+}
+
+// queues are the queues benchmarked, each created for at most capacity ids queued.
+var queues = []struct {
+	name string
+	new  func(capacity int) queue
+}{
+	{"slice", func(int) queue { return new(sliceQueue) }},
+	{"ring", func(int) queue { return new(ringQueue) }},
+	{"channel", func(capacity int) queue { return make(chanQueue, capacity) }},
+}
+
+// queueBenchmarks benchmarks the queues on each number of ids:
+//
+//	fill  enqueuing all the ids and then dequeuing them
+//	walk  enqueuing two ids for each one dequeued, as the frontier of a walk of a
+//	      graph grows, and then dequeuing the rest
+func queueBenchmarks(sizes []int) []benchmark {
+	var benchmarks []benchmark
+	for _, size := range sizes {
+		for _, q := range queues {
+			newQueue, size := q.new, size
+			benchmarks = append(benchmarks, benchmark{q.name + "/fill", size, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					q := newQueue(size)
+					for id := 0; id < size; id++ {
+						q.Enqueue(id)
+					}
+					for id, ok := q.Dequeue(); ok; id, ok = q.Dequeue() {
+						sink += id
+					}
+				}
+			}})
+		}
+		for _, q := range queues {
+			newQueue, size := q.new, size
+			benchmarks = append(benchmarks, benchmark{q.name + "/walk", size, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					q := newQueue(size + 1)
+					for id := 0; id < size; id++ {
+						q.Enqueue(id)
+						q.Enqueue(id)
+						n, _ := q.Dequeue()
+						sink += n
+					}
+					for id, ok := q.Dequeue(); ok; id, ok = q.Dequeue() {
+						sink += id
+					}
+				}
+			}})
+		}
+	}
+	return benchmarks
+}
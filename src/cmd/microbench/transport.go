@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"mpmc"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// transferChannel sends the values from producers goroutines to consumers goroutines
+// over a channel of the buffer size, and returns the sum of the values received.
+func transferChannel(values []int, producers, consumers, buffer int) int {
+	c := make(chan *int, buffer)
+	var sent, received sync.WaitGroup
+	var sum int64
+	for p := 0; p < producers; p++ {
+		sent.Add(1)
+		go func(p int) {
+			defer sent.Done()
+			for i := p; i < len(values); i += producers {
+				c <- &values[i]
+			}
+		}(p)
+	}
+	for i := 0; i < consumers; i++ {
+		received.Add(1)
+		go func() {
+			defer received.Done()
+			local := 0
+			for v := range c {
+				local += *v
+			}
+			atomic.AddInt64(&sum, int64(local))
+		}()
+	}
+	sent.Wait()
+	close(c)
+	received.Wait()
+	return int(sum)
+}
+
+// transferQueue sends the values from producers goroutines to consumers goroutines
+// over an mpmc queue of the buffer size rounded up to a power of 2, yielding while it is full or empty as the
+// concurrent-ring engine does, and returns the sum of the values received.
+func transferQueue(values []int, producers, consumers, buffer int) int {
+	q := mpmc.New(buffer)
+	var wg sync.WaitGroup
+	var sum, received int64
+	for p := 0; p < producers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+			for i := p; i < len(values); i += producers {
+				for !q.Put(&values[i]) {
+					runtime.Gosched()
+				}
+			}
+		}(p)
+	}
+	for i := 0; i < consumers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			local := 0
+			for atomic.LoadInt64(&received) < int64(len(values)) {
+				v, ok := q.Get()
+				if !ok {
+					runtime.Gosched()
+					continue
+				}
+				atomic.AddInt64(&received, 1)
+				local += *v.(*int)
+			}
+			atomic.AddInt64(&sum, int64(local))
+		}()
+	}
+	wg.Wait()
+	return int(sum)
+}
+
+// transports are the transports benchmarked.
+var transports = []struct {
+	name     string
+	transfer func(values []int, producers, consumers, buffer int) int
+}{
+	{"channel", transferChannel},
+	{"mpmc", transferQueue},
+}
+
+// transportBenchmarks benchmarks sending each number of values from producers to
+// consumers over each transport with each buffer size, for each number of producers
+// and consumers.
+func transportBenchmarks(sizes, buffers, producers, consumers []int) []benchmark {
+	var benchmarks []benchmark
+	for _, size := range sizes {
+		values := make([]int, size)
+		want := 0
+		for i := range values {
+			values[i] = i
+			want += i
+		}
+		for _, p := range producers {
+			for _, c := range consumers {
+				for _, buffer := range buffers {
+					for _, t := range transports {
+						name := fmt.Sprintf("%s/p%d-c%d-b%d", t.name, p, c, buffer)
+						transfer, p, c, buffer := t.transfer, p, c, buffer
+						benchmarks = append(benchmarks, benchmark{name, size, func(b *testing.B) {
+							for i := 0; i < b.N; i++ {
+								if sum := transfer(values, p, c, buffer); sum != want {
+									log.Fatalf("%s received a sum of %d, want %d", name, sum, want)
+								}
+							}
+						}})
+					}
+				}
+			}
+		}
+	}
+	return benchmarks
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// Reasons a node can never be activated.
+const (
+	// The node is not a seed and no node has it as a child.
+	NoParents = "no-parents"
+	// None of the parents of the node can be activated, Cause is one of them.
+	DeadParents = "dead-parents"
+	// The rule requires Cause, which is not the label of any node.
+	UnknownLabel = "unknown-label"
+	// The rule requires Cause, which can never be activated.
+	RequiresDead = "requires-dead"
+	// The rule requires Cause, which is only activated at Step, after every parent
+	// of the node reaches it.
+	RuleTooLate = "rule-too-late"
+	// The rule requires Cause, which is activated at Step as the last parent of the
+	// node reaches it. The simulations may activate the node, depending on the order
+	// they visit the nodes of the step in.
+	RuleSameStep = "rule-same-step"
+	// The node depends on itself through Cycle, with at least one rule in the way.
+	RuleCycle = "rule-cycle"
+	// The node is only a descendant of Cycle, which no seed leads into.
+	EdgeCycle = "edge-cycle"
+	// The node is activated at Step, after the depth of the analysis.
+	TooDeep = "too-deep"
+)
+
+// DeadNode is a node that can never be activated from the seeds of an analysis.
+type DeadNode struct {
+	Label  string
+	Reason string
+	Cause  string   `json:",omitempty"`
+	Cycle  []string `json:",omitempty"`
+	Step   int      `json:",omitempty"`
+}
+
+// dependency is a dead node the activation of another node depends on.
+type dependency struct {
+	id   int
+	rule bool
+}
+
+// AnalyzeDead finds the nodes of the activity that can never be activated, with the
+// reason of each. A node is dead if it has no parent that can be activated, if its
+// rule requires a node that cannot, or if its parents reach it before the labels of
+// its rule are active, as a rule is only checked then. So every dead node is
+// explained by a dead node it depends on, down to a node with no parents, an unknown
+// label, a rule too late or a cycle of dead nodes depending on each other. If depth
+// is not negative, the nodes activated after depth are reported as too deep.
+func AnalyzeDead(a *Activity, depth int) []DeadNode {
+	dead := make([]*DeadNode, len(a.Graph))
+	explained := func(i int) bool { return dead[i] != nil }
+	isDead := func(i int) bool { return a.steps[i] == unreached }
+
+	// dependencies returns the dead nodes a dead node depends on, the dead labels of
+	// its rule and its parents if none of them can be activated.
+	dependencies := func(i int) []dependency {
+		var deps []dependency
+		for _, label := range a.Graph[i].Rule {
+			if r, ok := a.ids[label]; ok && isDead(r) {
+				deps = append(deps, dependency{r, true})
+			}
+		}
+		for _, p := range a.parents[i] {
+			if !isDead(p) {
+				return deps
+			}
+		}
+		for _, p := range a.parents[i] {
+			deps = append(deps, dependency{p, false})
+		}
+		return deps
+	}
+
+	var queue []int
+	explain := func(i int, reason DeadNode) {
+		reason.Label = a.Graph[i].Label
+		dead[i] = &reason
+		queue = append(queue, a.Graph[i].Children...)
+		queue = append(queue, a.dependents[a.Graph[i].Label]...)
+	}
+	// propagate explains the dead nodes that depend on an explained one.
+	propagate := func() {
+		for len(queue) > 0 {
+			i := queue[0]
+			queue = queue[1:]
+			if !isDead(i) || explained(i) {
+				continue
+			}
+			for _, dep := range dependencies(i) {
+				if !explained(dep.id) {
+					continue
+				}
+				if dep.rule {
+					explain(i, DeadNode{Reason: RequiresDead, Cause: a.Graph[dep.id].Label})
+				} else {
+					explain(i, DeadNode{Reason: DeadParents, Cause: a.Graph[dep.id].Label})
+				}
+				break
+			}
+		}
+	}
+
+	for i, node := range a.Graph {
+		if !isDead(i) {
+			continue
+		}
+		for _, label := range node.Rule {
+			if _, ok := a.ids[label]; !ok {
+				explain(i, DeadNode{Reason: UnknownLabel, Cause: label})
+				break
+			}
+		}
+		if !explained(i) && len(a.parents[i]) == 0 {
+			explain(i, DeadNode{Reason: NoParents})
+		}
+		if !explained(i) {
+			if late, reach := lateRule(a, i); late >= 0 {
+				reason := DeadNode{Reason: RuleTooLate, Cause: a.Graph[late].Label, Step: a.steps[late]}
+				if a.steps[late] == reach+1 {
+					reason.Reason = RuleSameStep
+				}
+				explain(i, reason)
+			}
+		}
+	}
+	propagate()
+
+	// The dead nodes left depend only on unexplained dead nodes, so following their
+	// dependencies always leads to a cycle. Each cycle found explains its nodes and
+	// the nodes depending on them.
+	for i := range a.Graph {
+		if !isDead(i) || explained(i) {
+			continue
+		}
+		var path []int
+		var rules []bool
+		onPath := make(map[int]int)
+		j := i
+		for {
+			if k, ok := onPath[j]; ok {
+				path, rules = path[k:], rules[k:]
+				break
+			}
+			onPath[j] = len(path)
+			path = append(path, j)
+			dep := dependencies(j)[0]
+			for _, d := range dependencies(j) {
+				if !explained(d.id) && d.rule {
+					dep = d
+					break
+				}
+			}
+			rules = append(rules, dep.rule)
+			j = dep.id
+		}
+
+		reason := EdgeCycle
+		for _, rule := range rules {
+			if rule {
+				reason = RuleCycle
+			}
+		}
+		var cycle []string
+		for _, id := range path {
+			cycle = append(cycle, a.Graph[id].Label)
+		}
+		cycle = append(cycle, cycle[0])
+		for _, id := range path {
+			explain(id, DeadNode{Reason: reason, Cycle: cycle})
+		}
+		propagate()
+	}
+
+	var nodes []DeadNode
+	for i, reason := range dead {
+		if reason != nil {
+			nodes = append(nodes, *reason)
+		} else if depth >= 0 && a.steps[i] > depth {
+			nodes = append(nodes, DeadNode{Label: a.Graph[i].Label, Reason: TooDeep, Step: a.steps[i]})
+		}
+	}
+	return nodes
+}
+
+// lateRule returns the latest label of the rule of node i and the step of its latest
+// parent if every label and a parent can be activated, or -1 otherwise.
+func lateRule(a *Activity, i int) (int, int) {
+	late := -1
+	for _, label := range a.Graph[i].Rule {
+		r, ok := a.ids[label]
+		if !ok || a.steps[r] == unreached {
+			return -1, 0
+		}
+		if late < 0 || a.steps[r] > a.steps[late] {
+			late = r
+		}
+	}
+	reach := unreached
+	for _, p := range a.parents[i] {
+		if a.steps[p] > reach {
+			reach = a.steps[p]
+		}
+	}
+	if reach == unreached {
+		return -1, 0
+	}
+	return late, reach
+}
+
+func (d DeadNode) String() string {
+	switch d.Reason {
+	case NoParents:
+		return fmt.Sprintf("%s: has no parents and is not a seed", d.Label)
+	case DeadParents:
+		return fmt.Sprintf("%s: none of its parents can be activated, such as %s", d.Label, d.Cause)
+	case UnknownLabel:
+		return fmt.Sprintf("%s: rule requires %q which is not a node", d.Label, d.Cause)
+	case RequiresDead:
+		return fmt.Sprintf("%s: rule requires %s which can never be activated", d.Label, d.Cause)
+	case RuleTooLate:
+		return fmt.Sprintf("%s: rule requires %s which is only activated at step %d, after its parents reach it", d.Label, d.Cause, d.Step)
+	case RuleSameStep:
+		return fmt.Sprintf("%s: rule requires %s which is activated at step %d as its parents reach it, depending on the order of the nodes of the step", d.Label, d.Cause, d.Step)
+	case RuleCycle:
+		return fmt.Sprintf("%s: rule cycle %s", d.Label, strings.Join(d.Cycle, " -> "))
+	case EdgeCycle:
+		return fmt.Sprintf("%s: only reachable from cycle %s which no seed leads into", d.Label, strings.Join(d.Cycle, " -> "))
+	case TooDeep:
+		return fmt.Sprintf("%s: activated at step %d, after the depth", d.Label, d.Step)
+	}
+	return fmt.Sprintf("%s: %s", d.Label, d.Reason)
+}
+
+// printDeadNodes prints each dead node with the chain of reasons that explains it,
+// down to the node that is dead on its own.
+func printDeadNodes(w io.Writer, nodes []DeadNode) {
+	byLabel := make(map[string]DeadNode, len(nodes))
+	for _, d := range nodes {
+		byLabel[d.Label] = d
+	}
+	for _, d := range nodes {
+		fmt.Fprintln(w, d)
+		printReasons(w, d, byLabel)
+	}
+}
+
+// printReasons prints the chain of reasons of a dead node after the first.
+func printReasons(w io.Writer, d DeadNode, byLabel map[string]DeadNode) {
+	for d.Reason == DeadParents || d.Reason == RequiresDead {
+		d = byLabel[d.Cause]
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+}
+
+func AnalyzeGraph(c *cli.Context) {
+	graph := load(c.String("input"))
+	if _, err := NewLabelIndex(graph); err != nil {
+		log.Fatal(err)
+	}
+	seeds := c.StringSlice("seed")
+	if len(seeds) == 0 && len(graph) > 0 {
+		seeds = []string{graph[0].Label}
+	}
+	a := NewActivity(graph, seeds)
+	for _, seed := range seeds {
+		if _, ok := a.ids[seed]; !ok {
+			log.Fatalf("analyze: unknown seed %q", seed)
+		}
+	}
+	depth := -1
+	if c.IsSet("depth") {
+		depth = c.Int("depth")
+	}
+	nodes := AnalyzeDead(a, depth)
+
+	switch c.String("format") {
+	case "text":
+		printDeadNodes(os.Stdout, nodes)
+		fmt.Printf("Graph Size: %d\nDead nodes: %d\n", len(graph), len(nodes))
+	case "json":
+		b, err := json.MarshalIndent(nodes, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+	default:
+		log.Fatalf("analyze: unknown format %q, use text or json", c.String("format"))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAnalyzeDeadRules(t *testing.T) {
+	graph, err := compileDSL("testdata/dead.kg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewActivity(graph, []string{graph[0].Label})
+	reasons := make(map[string]string)
+	for _, d := range AnalyzeDead(a, -1) {
+		reasons[d.Label] = d.Reason
+	}
+	want := map[string]string{"late": RuleTooLate, "same": RuleSameStep, "child": DeadParents}
+	for label, reason := range want {
+		if reasons[label] != reason {
+			t.Errorf("%s is reported %q, want %q", label, reasons[label], reason)
+		}
+	}
+	if len(reasons) != len(want) {
+		t.Errorf("dead nodes %v, want %v", reasons, want)
+	}
+	if step := a.Step("ok"); step != 2 {
+		t.Errorf("ok is active at step %d, want 2", step)
+	}
+
+	// Whatever the order the engines visit the nodes in, c reaches late before it
+	// reaches x, so before e is active.
+	for _, name := range engineNames() {
+		for n := 0; n < 20; n++ {
+			run := engines[name].Simulate(graph, Options{Depth: 10, Workers: 4, BufferSize: 1, BatchSize: 1})
+			for _, label := range []string{"late", "child"} {
+				if _, ok := run.Actives[label]; ok {
+					t.Fatalf("engine %s activated %s", name, label)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Calibration is the size of graph from which an engine beats the sequential test
+// simulation on a machine, as measured by the calibrate command.
+type Calibration struct {
+	CPUs       int
+	GOMAXPROCS int
+	// Degree is the average number of children of the nodes of the graphs measured.
+	Degree float64
+	// Crossover is the smallest size measured from which Engine is faster than the
+	// sequential engine on every larger graph measured. Engine is sequential if it
+	// never is.
+	Crossover int
+	Engine    string
+	// Workers is the number of workers Engine is the fastest with on the largest graph.
+	Workers  int
+	Batch    int
+	Measured time.Time `json:",omitempty"`
+	// Points are the mean times of the engines on each size measured.
+	Points []CalibrationPoint `json:",omitempty"`
+}
+
+type CalibrationPoint struct {
+	Size   int
+	Degree float64
+	// Times are the times of each engine with its fastest number of workers, given
+	// by Workers for the engines using workers.
+	Times   map[string]time.Duration
+	Workers map[string]int `json:",omitempty"`
+}
+
+// calibratedEngines are the engines measured by the calibrate command. Ties between
+// their times go to the first.
+var calibratedEngines = []string{"sequential", "concurrent", "parallel"}
+
+// workerCounts returns the powers of 2 below the number of cores and the number of
+// cores, in increasing order.
+func workerCounts(cpus int) []int {
+	var counts []int
+	for n := 1; n < cpus; n *= 2 {
+		counts = append(counts, n)
+	}
+	return append(counts, cpus)
+}
+
+// defaultCalibration is used until the machine is calibrated. Its crossover is the one
+// found in the paper, around 1000 nodes.
+func defaultCalibration() *Calibration {
+	cal := &Calibration{
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(-1),
+		Degree:     averageDegree(generateRandomTreeWithRules(4, 1000, 1)),
+		Crossover:  1000,
+		Engine:     "concurrent",
+		Workers:    runtime.NumCPU(),
+		Batch:      64,
+	}
+	if cal.CPUs > 1 {
+		cal.Engine = "parallel"
+	}
+	return cal
+}
+
+// loadCalibration reads the calibration stored in file, or returns the default one if
+// there is none.
+func loadCalibration(file string) (*Calibration, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return defaultCalibration(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cal := new(Calibration)
+	if err := json.Unmarshal(data, cal); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return cal, nil
+}
+
+func averageDegree(graph []*LabelNode) float64 {
+	if len(graph) == 0 {
+		return 0
+	}
+	edges := 0
+	for _, node := range graph {
+		edges += len(node.Children)
+	}
+	return float64(edges) / float64(len(graph))
+}
+
+// autoEngine picks the engine and number of workers to run over the graph: the
+// sequential engine below the crossover of the calibration and its engine from it.
+// The size of the graph is scaled by its average degree relative to the graphs
+// calibrated on, as the work of a simulation grows with the number of edges rather
+// than of nodes. The workers are capped to the cores of this machine, in case the
+// calibration was made on another.
+func autoEngine(graph []*LabelNode, cal *Calibration) (string, int) {
+	size := float64(len(graph))
+	if cal.Degree > 0 {
+		size *= averageDegree(graph) / cal.Degree
+	}
+	if cal.Engine == "sequential" || size < float64(cal.Crossover) {
+		return "sequential", 1
+	}
+	workers := cal.Workers
+	if workers > runtime.NumCPU() {
+		workers = runtime.NumCPU()
+	}
+	return cal.Engine, workers
+}
+
+// crossover sets the engine, workers and crossover of the calibration from its
+// points: the engine other than sequential that is the fastest on the largest graph,
+// with its fastest number of workers there, from the smallest size it is faster than
+// the sequential engine on every larger graph.
+func (cal *Calibration) crossover() {
+	cal.Engine, cal.Crossover = "sequential", 0
+	if len(cal.Points) == 0 {
+		return
+	}
+	last := cal.Points[len(cal.Points)-1]
+	for _, engine := range calibratedEngines {
+		t, ok := last.Times[engine]
+		if ok && engine != "sequential" && t < last.Times["sequential"] &&
+			(cal.Engine == "sequential" || t < last.Times[cal.Engine]) {
+			cal.Engine = engine
+		}
+	}
+	if cal.Engine == "sequential" {
+		return
+	}
+	if workers, ok := last.Workers[cal.Engine]; ok {
+		cal.Workers = workers
+	}
+	for i := len(cal.Points) - 1; i >= 0; i-- {
+		p := cal.Points[i]
+		if p.Times[cal.Engine] >= p.Times["sequential"] {
+			break
+		}
+		cal.Crossover = p.Size
+	}
+}
+
+func Calibrate(c *cli.Context) {
+	sizes, err := parseInts(c.String("size"))
+	if err != nil {
+		log.Fatalf("calibrate: %v", err)
+	}
+	trials := c.Int("trials")
+	if trials < 1 {
+		log.Fatal("calibrate: trials must be at least 1")
+	}
+	cal := &Calibration{
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(-1),
+		Workers:    1,
+		Batch:      c.Int("batch"),
+		Measured:   time.Now(),
+	}
+	counts := workerCounts(cal.CPUs)
+	if c.IsSet("workers") {
+		if counts, err = parseInts(c.String("workers")); err != nil {
+			log.Fatalf("calibrate: %v", err)
+		}
+	}
+
+	profiles := newProfiles(c)
+	graphs := make([][]*LabelNode, len(sizes))
+	for i, size := range sizes {
+		graphs[i] = generateRandomTreeWithRules(4, size, int64(c.Int("seed")))
+	}
+
+	fmt.Printf("Calibration Info:\nDepth: %d\nTrials: %d\nNum of Cores: %d\nGOMAXPROCS: %d\nWorkers: %s\nBatch Size: %d\n",
+		c.Int("depth"), trials, cal.CPUs, cal.GOMAXPROCS, strings.Trim(fmt.Sprint(counts), "[]"), cal.Batch)
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Size\tDegree\tSequential\tConcurrent\tWorkers\tParallel\tWorkers\t")
+	profiles.start()
+	for i, size := range sizes {
+		graph := graphs[i]
+		p := CalibrationPoint{Size: size, Degree: averageDegree(graph), Times: make(map[string]time.Duration), Workers: make(map[string]int)}
+		fmt.Fprintf(w, "%d\t%.2f\t", size, p.Degree)
+		for _, engine := range calibratedEngines {
+			// The engines using workers keep their fastest count, the fewest workers on a tie.
+			engineCounts := counts
+			if !engines[engine].Uses("workers") {
+				engineCounts = []int{1}
+			}
+			for _, workers := range engineCounts {
+				opts := Options{Depth: c.Int("depth"), Workers: workers, BufferSize: size * 10, BatchSize: cal.Batch}
+				m, err := measure(engine, graph, opts, trials)
+				if err != nil {
+					log.Fatalf("calibrate: %v", err)
+				}
+				if t, ok := p.Times[engine]; !ok || m.Mean() < t {
+					p.Times[engine] = m.Mean()
+					if engines[engine].Uses("workers") {
+						p.Workers[engine] = workers
+					}
+				}
+			}
+			fmt.Fprintf(w, "%s\t", p.Times[engine])
+			if engines[engine].Uses("workers") {
+				fmt.Fprintf(w, "%d\t", p.Workers[engine])
+			}
+		}
+		fmt.Fprintln(w)
+		cal.Points = append(cal.Points, p)
+		cal.Degree += p.Degree / float64(len(sizes))
+	}
+	w.Flush()
+	profiles.stop()
+
+	cal.crossover()
+	fmt.Printf("Engine: %s\nWorkers: %d\nCrossover: %d\n", cal.Engine, cal.Workers, cal.Crossover)
+	b, err := json.MarshalIndent(cal, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeFileAtomic(c.String("calibration"), b, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Calibration written to %s\n", c.String("calibration"))
+}
+
+// autoOptions picks the engine for the graph with autoEngine and sets the workers and
+// batch size calibrated for it, unless they are set by the flags of the command.
+func autoOptions(c *cli.Context, graph []*LabelNode, opts *Options) string {
+	cal, err := loadCalibration(c.String("calibration"))
+	if err != nil {
+		log.Fatalf("%s: %v", c.Command.Name, err)
+	}
+	engine, workers := autoEngine(graph, cal)
+	if !c.IsSet("workers") {
+		opts.Workers = workers
+	}
+	if !c.IsSet("batch") && cal.Batch > 0 {
+		opts.BatchSize = cal.Batch
+	}
+	fmt.Printf("Auto Engine: %s (crossover %d, degree %.2f against %.2f)\n",
+		engine, cal.Crossover, averageDegree(graph), cal.Degree)
+	return engine
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Machine describes the machine a baseline was measured on. Times are only compared
+// with the baselines of the same machine.
+type Machine struct {
+	OS         string
+	Arch       string
+	CPU        string
+	CPUs       int
+	GOMAXPROCS int
+	GoVersion  string
+}
+
+func currentMachine() Machine {
+	return Machine{
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPU:        cpuModel(),
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(-1),
+		GoVersion:  runtime.Version(),
+	}
+}
+
+// cpuModel returns the model name of the processor, or unknown where it is not
+// listed in /proc/cpuinfo.
+func cpuModel() string {
+	f, err := os.Open("/proc/cpuinfo")
+	if err != nil {
+		return "unknown"
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "model name" {
+			return strings.TrimSpace(fields[1])
+		}
+	}
+	return "unknown"
+}
+
+// Key names the machine by its system, architecture and number of processors, and a
+// hash of its processor model and GOMAXPROCS, such as linux-amd64-8cpu-3f2a9c1e07b4.
+// The Go version is not part of the key so that a new toolchain is compared with the
+// baselines of the previous one.
+func (m Machine) Key() string {
+	sum := sha256.Sum256([]byte(m.CPU + "\x00" + strconv.Itoa(m.GOMAXPROCS)))
+	return fmt.Sprintf("%s-%s-%dcpu-%s", m.OS, m.Arch, m.CPUs, hex.EncodeToString(sum[:6]))
+}
+
+// Baseline is the times of an engine with options on a graph, stored by the bench
+// save command and compared with by the bench compare command.
+type Baseline struct {
+	Machine Machine
+	Engine  string
+	Options Options
+	// Graph is the fingerprint of the graph, Input the file it was read from.
+	Graph    string
+	Input    string
+	Size     int
+	Times    []time.Duration
+	Recorded time.Time
+}
+
+// baselineFile returns the file of the baseline of the engine with the options on
+// the graph of fingerprint hash, under a directory of the machine and one of the graph:
+// dir/linux-amd64-8cpu-3f2a9c1e07b4/9a0b1c2d3e4f5a6b/concurrent-d100-r4-b10000-n64.json
+func baselineFile(dir string, machine Machine, hash, engine string, opts Options) string {
+	graph := strings.TrimPrefix(hash, "sha256:")
+	if len(graph) > 16 {
+		graph = graph[:16]
+	}
+	return filepath.Join(dir, machine.Key(), graph, optionsName(engine, opts)+".json")
+}
+
+// readBaseline reads a baseline file. The baseline is nil if there is no file.
+func readBaseline(file string) (*Baseline, error) {
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := new(Baseline)
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return b, nil
+}
+
+func median(times []time.Duration) time.Duration {
+	sorted := append([]time.Duration(nil), times...)
+	sort.Sort(durations(sorted))
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// mannWhitney returns the p-value of the one-sided Mann-Whitney U test that the times
+// of y tend to be larger than the times of x. The p-value is exact for samples without
+// ties of up to 20 times each, and from the normal approximation with a correction
+// for ties and continuity otherwise.
+func mannWhitney(x, y []time.Duration) float64 {
+	n, m := len(x), len(y)
+	if n == 0 || m == 0 {
+		return 1
+	}
+	// u counts the pairs where y is larger, ties counting half.
+	u := 0.0
+	ties := false
+	for _, a := range x {
+		for _, b := range y {
+			switch {
+			case b > a:
+				u++
+			case b == a:
+				u += 0.5
+				ties = true
+			}
+		}
+	}
+	if !ties && n <= 20 && m <= 20 {
+		return exactMannWhitney(n, m, int(u))
+	}
+
+	// The variance is corrected by the sizes of the groups of tied times.
+	all := append(append([]time.Duration(nil), x...), y...)
+	sort.Sort(durations(all))
+	tieSum := 0.0
+	for i := 0; i < len(all); {
+		j := i
+		for j < len(all) && all[j] == all[i] {
+			j++
+		}
+		t := float64(j - i)
+		tieSum += t*t*t - t
+		i = j
+	}
+	N := float64(n + m)
+	mean := float64(n*m) / 2
+	variance := float64(n*m) / 12 * (N + 1 - tieSum/(N*(N-1)))
+	if variance == 0 {
+		return 1
+	}
+	z := (u - mean - 0.5) / math.Sqrt(variance)
+	return math.Erfc(z/math.Sqrt2) / 2
+}
+
+// exactMannWhitney returns the probability that U is at least u for samples of n and
+// m values without ties, counting the orderings of the samples giving each U.
+func exactMannWhitney(n, m, u int) float64 {
+	// counts[i][j][k] is the number of orderings of i values of x and j values of y
+	// where k pairs have the value of y larger, built by the last value being either.
+	max := n * m
+	counts := make([][][]float64, n+1)
+	for i := range counts {
+		counts[i] = make([][]float64, m+1)
+		for j := range counts[i] {
+			counts[i][j] = make([]float64, max+1)
+			if i == 0 || j == 0 {
+				counts[i][j][0] = 1
+				continue
+			}
+			for k := 0; k <= max; k++ {
+				// The last value is of y, larger than the i values of x, or of x.
+				if k >= i {
+					counts[i][j][k] += counts[i][j-1][k-i]
+				}
+				counts[i][j][k] += counts[i-1][j][k]
+			}
+		}
+	}
+	total, above := 0.0, 0.0
+	for k, c := range counts[n][m] {
+		total += c
+		if k >= u {
+			above += c
+		}
+	}
+	return above / total
+}
+
+// baselineFlags are the flags of the bench subcommands storing and comparing
+// baselines, followed by the flags given. Their graphs must be files, the flags of
+// the generated graphs are left out.
+func baselineFlags(flags ...cli.Flag) []cli.Flag {
+	var all []cli.Flag
+	for _, f := range benchFlags(flags...) {
+		switch f := f.(type) {
+		case cli.StringFlag:
+			if f.Name == "size, s" {
+				continue
+			}
+		case cli.IntFlag:
+			if f.Name == "seed" {
+				continue
+			}
+		case cli.StringSliceFlag:
+			if f.Name == "input, i" {
+				f.Usage = "Path to json file containing a graph. Can be repeated, at least one is required as the labels of generated graphs are random."
+				all = append(all, f)
+				continue
+			}
+		}
+		all = append(all, f)
+	}
+	return all
+}
+
+// minMannWhitney returns the smallest p-value of mannWhitney for samples of n and m
+// times, when all the times of one sample are larger than those of the other.
+func minMannWhitney(n, m int) float64 {
+	// The probability of the one ordering among the C(n+m, n) of the samples.
+	p := 1.0
+	for i := 1; i <= n; i++ {
+		p *= float64(i) / float64(m+i)
+	}
+	return p
+}
+
+// baselineSuite reads the suite of a bench subcommand, which measures graph files
+// only as generated graphs do not keep their fingerprint.
+func baselineSuite(c *cli.Context, cmd string) *benchSuite {
+	if len(c.StringSlice("input")) == 0 {
+		log.Fatalf("%s: give graph files with --input, the labels of generated graphs are random", cmd)
+	}
+	return newBenchSuite(c, cmd)
+}
+
+func BenchSave(c *cli.Context) {
+	s := baselineSuite(c, "bench save")
+	dir := c.String("baselines")
+	machine := currentMachine()
+	fmt.Printf("Machine: %s\nCPU: %s\n", machine.Key(), machine.CPU)
+	s.run(func(g benchGraph, hash string, measurements []Measurement) {
+		printMeasurements(measurements)
+		for _, m := range measurements {
+			b := &Baseline{
+				Machine:  machine,
+				Engine:   m.Engine,
+				Options:  m.Options,
+				Graph:    hash,
+				Input:    g.name,
+				Size:     len(g.graph),
+				Times:    m.Times,
+				Recorded: time.Now(),
+			}
+			data, err := json.MarshalIndent(b, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			file := baselineFile(dir, machine, hash, m.Engine, m.Options)
+			if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+				log.Fatal(err)
+			}
+			if c.Bool("force") {
+				err = writeFileAtomic(file, data, 0644)
+			} else {
+				err = writeFileNoClobber(file, data, 0644)
+			}
+			if err != nil {
+				log.Fatalf("bench save: %v", err)
+			}
+			fmt.Printf("Baseline written to %s\n", file)
+		}
+	})
+}
+
+func BenchCompare(c *cli.Context) {
+	s := baselineSuite(c, "bench compare")
+	dir := c.String("baselines")
+	threshold, alpha := c.Float64("threshold"), c.Float64("alpha")
+	if p := minMannWhitney(s.trials, s.trials); p >= alpha {
+		log.Fatalf("bench compare: with %d trials the p-value is at least %.3f, it cannot be below an alpha of %g, use more trials",
+			s.trials, p, alpha)
+	}
+	machine := currentMachine()
+	fmt.Printf("Machine: %s\nCPU: %s\nThreshold: %g\nAlpha: %g\n", machine.Key(), machine.CPU, threshold, alpha)
+
+	regressions, inconclusive := 0, 0
+	s.run(func(g benchGraph, hash string, measurements []Measurement) {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "Engine\tWorkers\tBatch\tBaseline\tCurrent\tChange\tp\tResult\t")
+		for _, m := range measurements {
+			workers, batch := "-", "-"
+			engine := engines[m.Engine]
+			if engine.Uses("workers") {
+				workers = strconv.Itoa(m.Options.Workers)
+			}
+			if engine.Uses("batch") {
+				batch = strconv.Itoa(m.Options.BatchSize)
+			}
+			current := median(m.Times)
+			b, err := readBaseline(baselineFile(dir, machine, hash, m.Engine, m.Options))
+			if err != nil {
+				log.Fatalf("bench compare: %v", err)
+			}
+			if b == nil {
+				fmt.Fprintf(w, "%s\t%s\t%s\t-\t%s\t-\t-\tno baseline\t\n", m.Engine, workers, batch, current)
+				continue
+			}
+			if p := minMannWhitney(len(b.Times), len(m.Times)); p >= alpha {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t-\t-\ttoo few trials (%d)\t\n", m.Engine, workers, batch, median(b.Times), current, len(b.Times))
+				inconclusive++
+				continue
+			}
+			base := median(b.Times)
+			change := float64(current)/float64(base) - 1
+			slower, faster := mannWhitney(b.Times, m.Times), mannWhitney(m.Times, b.Times)
+			p, result := slower, "same"
+			switch {
+			case slower < alpha && change > threshold:
+				result = "REGRESSION"
+				regressions++
+			case faster < alpha && change < -threshold:
+				p, result = faster, "faster"
+			}
+			if b.Machine.GoVersion != machine.GoVersion {
+				result += " (" + b.Machine.GoVersion + ")"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%+.1f%%\t%.3f\t%s\t\n", m.Engine, workers, batch, base, current, change*100, p, result)
+		}
+		w.Flush()
+	})
+	if inconclusive > 0 {
+		fmt.Printf("\nBaselines with too few trials: %d\n", inconclusive)
+	}
+	if regressions > 0 {
+		fmt.Printf("\nRegressions: %d\n", regressions)
+	}
+	if regressions > 0 || inconclusive > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("\nNo regressions")
+}
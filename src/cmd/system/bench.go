@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// benchGraph is a graph benchmarked, with the name it is reported by.
+type benchGraph struct {
+	name  string
+	graph []*LabelNode
+}
+
+// Measurement is the timing of an engine over a graph.
+type Measurement struct {
+	Engine  string
+	Options Options
+	Actives int
+	Times   []time.Duration
+}
+
+func (m Measurement) Mean() time.Duration {
+	var total time.Duration
+	for _, t := range m.Times {
+		total += t
+	}
+	return total / time.Duration(len(m.Times))
+}
+
+func (m Measurement) Min() time.Duration {
+	min := m.Times[0]
+	for _, t := range m.Times[1:] {
+		if t < min {
+			min = t
+		}
+	}
+	return min
+}
+
+// parseInts parses a comma separated list of integers, such as 1,2,4,8.
+func parseInts(list string) ([]int, error) {
+	var ints []int
+	for _, s := range strings.Split(list, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a list of integers", list)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
+
+// measure runs the engine over the graph trials times after a first run to warm up.
+func measure(name string, graph []*LabelNode, opts Options, trials int) (Measurement, error) {
+	m := Measurement{Engine: name, Options: opts}
+	engine, err := lookupEngine(name)
+	if err != nil {
+		return m, err
+	}
+	for trial := 0; trial <= trials; trial++ {
+		runtime.GC()
+		start := time.Now()
+		run := engine.Simulate(graph, opts)
+		elapsed := time.Since(start)
+		if trial > 0 {
+			m.Times = append(m.Times, elapsed)
+			m.Actives = len(run.Actives)
+		}
+	}
+	return m, nil
+}
+
+// printMeasurements prints the measurements of a graph with their speedup over the
+// first one.
+func printMeasurements(measurements []Measurement) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "Engine\tWorkers\tBatch\tActives\tMean\tMin\tSpeedup\t")
+	for _, m := range measurements {
+		workers, batch := "-", "-"
+		engine := engines[m.Engine]
+		if engine.Uses("workers") {
+			workers = strconv.Itoa(m.Options.Workers)
+		}
+		if engine.Uses("batch") {
+			batch = strconv.Itoa(m.Options.BatchSize)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%.2f\t\n", m.Engine, workers, batch, m.Actives, m.Mean(), m.Min(),
+			float64(measurements[0].Mean())/float64(m.Mean()))
+	}
+	w.Flush()
+}
+
+// benchFlags are the flags of the bench command and its subcommands, followed by
+// the flags given and the profiling flags.
+func benchFlags(flags ...cli.Flag) []cli.Flag {
+	flags = append([]cli.Flag{
+		cli.StringSliceFlag{
+			Name:  "engine, e",
+			Value: &cli.StringSlice{},
+			Usage: "Engine to run. Can be repeated. If not set, test, concurrent and parallel.",
+		},
+		cli.StringFlag{
+			Name:  "workers, w",
+			Value: "1,2,4,8",
+			Usage: "Comma separated numbers of workers of the concurrent and parallel engines.",
+		},
+		cli.StringSliceFlag{
+			Name:  "input, i",
+			Value: &cli.StringSlice{},
+			Usage: "Path to json file containing a graph. Can be repeated. If not set, graphs are generated.",
+		},
+		cli.StringFlag{
+			Name:  "size, s",
+			Value: "1000000",
+			Usage: "Comma separated sizes of the generated graphs.",
+		},
+		cli.IntFlag{
+			Name:  "seed",
+			Value: 1,
+			Usage: "The seed of the random generator of the graphs.",
+		},
+		cli.IntFlag{
+			Name:   "depth, d",
+			Value:  100,
+			Usage:  "The depth for each simulation run",
+			EnvVar: "SIM_DEPTH",
+		},
+		cli.IntFlag{
+			Name:  "trials, t",
+			Value: 5,
+			Usage: "The number of timed runs of each engine.",
+		},
+		cli.IntFlag{
+			Name:  "buffer, b",
+			Usage: "The buffer size of the channels of the concurrent engine. If not set it is scaled to graph size: size * 10",
+		},
+		cli.StringFlag{
+			Name:  "batch",
+			Value: "1,64",
+			Usage: "Comma separated numbers of nodes sent at once over the channels of the concurrent engine.",
+		},
+	}, flags...)
+	return append(flags, profileFlags...)
+}
+
+// benchSuite is the engines, options and graphs a bench command measures.
+type benchSuite struct {
+	names        []string
+	workerCounts []int
+	batchSizes   []int
+	trials       int
+	depth        int
+	// buffer is the buffer size of the concurrent engine, 0 to scale it to the graph.
+	buffer   int
+	graphs   []benchGraph
+	profiles *profiles
+}
+
+// newBenchSuite reads the suite from the flags of the bench command named cmd,
+// generating the graphs if no input is given.
+func newBenchSuite(c *cli.Context, cmd string) *benchSuite {
+	s := &benchSuite{names: c.StringSlice("engine"), trials: c.Int("trials"), depth: c.Int("depth")}
+	if len(s.names) == 0 {
+		s.names = []string{"test", "concurrent", "parallel"}
+	}
+	for _, name := range s.names {
+		if _, err := lookupEngine(name); err != nil {
+			log.Fatalf("%s: %v", cmd, err)
+		}
+	}
+	var err error
+	if s.workerCounts, err = parseInts(c.String("workers")); err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+	if s.batchSizes, err = parseInts(c.String("batch")); err != nil {
+		log.Fatalf("%s: %v", cmd, err)
+	}
+	if s.trials < 1 {
+		log.Fatalf("%s: trials must be at least 1", cmd)
+	}
+	if c.IsSet("buffer") {
+		s.buffer = c.Int("buffer")
+	}
+	s.profiles = newProfiles(c)
+
+	for _, input := range c.StringSlice("input") {
+		s.graphs = append(s.graphs, benchGraph{input, load(input)})
+	}
+	if len(s.graphs) == 0 {
+		sizes, err := parseInts(c.String("size"))
+		if err != nil {
+			log.Fatalf("%s: %v", cmd, err)
+		}
+		for _, size := range sizes {
+			graph := generateRandomTreeWithRules(4, size, int64(c.Int("seed")))
+			s.graphs = append(s.graphs, benchGraph{fmt.Sprintf("generated %d", size), graph})
+		}
+	}
+	return s
+}
+
+// run measures each engine with each of its options over each graph, and calls each
+// with the measurements of a graph after printing its name, size and hash. The
+// profiles cover all the measurements, with the calls of each in between.
+func (s *benchSuite) run(each func(g benchGraph, hash string, measurements []Measurement)) {
+	fmt.Printf("Bench Info:\nDepth: %d\nTrials: %d\nNum of Cores: %d\nGOMAXPROCS: %d\n",
+		s.depth, s.trials, runtime.NumCPU(), runtime.GOMAXPROCS(-1))
+	s.profiles.start()
+	for _, g := range s.graphs {
+		bufferSize := s.buffer
+		if bufferSize == 0 {
+			bufferSize = len(g.graph) * 10
+		}
+		hash := GraphHash(g.graph)
+		fmt.Printf("\nGraph: %s\nGraph Size: %d\nGraph Hash: %s\n", g.name, len(g.graph), hash)
+
+		var measurements []Measurement
+		for _, name := range s.names {
+			counts := s.workerCounts
+			if !engines[name].Uses("workers") {
+				counts = s.workerCounts[:1]
+			}
+			batches := s.batchSizes
+			if !engines[name].Uses("batch") {
+				batches = s.batchSizes[:1]
+			}
+			for _, workers := range counts {
+				for _, batchSize := range batches {
+					opts := Options{Depth: s.depth, Workers: workers, BufferSize: bufferSize, BatchSize: batchSize}
+					m, err := measure(name, g.graph, opts, s.trials)
+					if err != nil {
+						log.Fatalf("bench: %v", err)
+					}
+					measurements = append(measurements, m)
+				}
+			}
+		}
+		each(g, hash, measurements)
+	}
+	s.profiles.stop()
+}
+
+func BenchEngines(c *cli.Context) {
+	newBenchSuite(c, "bench").run(func(g benchGraph, hash string, measurements []Measurement) {
+		printMeasurements(measurements)
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// diffSide is one of the two runs compared by a diff, with a name to report it by.
+type diffSide struct {
+	Name string
+	Run  *Run
+}
+
+// Change is a node whose activation differs between two runs. Step is unreached
+// in the run where the node is not active.
+type Change struct {
+	Label string
+	Steps [2]int
+}
+
+// first returns the step at which the change first shows.
+func (c Change) first() int {
+	if c.Steps[0] == unreached {
+		return c.Steps[1]
+	}
+	if c.Steps[1] == unreached || c.Steps[0] < c.Steps[1] {
+		return c.Steps[0]
+	}
+	return c.Steps[1]
+}
+
+// RunDiff lists the nodes gained, lost and activated at another step by the second
+// run compared to the first, each ordered by step then label.
+type RunDiff struct {
+	Gained  []Change
+	Lost    []Change
+	Changed []Change
+}
+
+// activationStep returns the step at which the node with the label was activated in
+// the run, or unreached.
+func activationStep(r *Run, label string) int {
+	node, ok := r.Actives[label]
+	if !ok {
+		return unreached
+	}
+	return r.Step(node)
+}
+
+func DiffRuns(a, b *Run) *RunDiff {
+	d := new(RunDiff)
+	for label, node := range a.Actives {
+		change := Change{label, [2]int{a.Step(node), activationStep(b, label)}}
+		if change.Steps[1] == unreached {
+			d.Lost = append(d.Lost, change)
+		} else if change.Steps[0] != change.Steps[1] {
+			d.Changed = append(d.Changed, change)
+		}
+	}
+	for label, node := range b.Actives {
+		if _, ok := a.Actives[label]; !ok {
+			d.Gained = append(d.Gained, Change{label, [2]int{unreached, b.Step(node)}})
+		}
+	}
+	sort.Sort(byFirstStep(d.Gained))
+	sort.Sort(byFirstStep(d.Lost))
+	sort.Sort(byFirstStep(d.Changed))
+	return d
+}
+
+// First returns the change that shows at the earliest step, or nil if the runs are
+// the same.
+func (d *RunDiff) First() *Change {
+	var changes []Change
+	changes = append(changes, d.Gained...)
+	changes = append(changes, d.Lost...)
+	changes = append(changes, d.Changed...)
+	if len(changes) == 0 {
+		return nil
+	}
+	sort.Sort(byFirstStep(changes))
+	return &changes[0]
+}
+
+type byFirstStep []Change
+
+func (a byFirstStep) Len() int      { return len(a) }
+func (a byFirstStep) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byFirstStep) Less(i, j int) bool {
+	if a[i].first() != a[j].first() {
+		return a[i].first() < a[j].first()
+	}
+	return a[i].Label < a[j].Label
+}
+
+// explainDivergence explains why the node activated at step in from was not
+// activated by that step in to: the node, the edge from its parent or a label of its
+// rule missing from the graph of to, or not active in time. If none of them is
+// missing, the engine of to missed an activation it could have made.
+func explainDivergence(from, to diffSide, label string, step int) []string {
+	node := from.Run.Actives[label]
+	var reasons []string
+	if step == 0 {
+		reasons = append(reasons, fmt.Sprintf("%s is a seed in %s", label, from.Name))
+	} else {
+		parent := activeParent(from.Run, node)
+		rule := ""
+		if len(node.Rule) > 0 {
+			rule = fmt.Sprintf(" and rule %s", strings.Join(node.Rule, " & "))
+		}
+		reasons = append(reasons, fmt.Sprintf("%s is activated at step %d in %s from %s%s",
+			label, step, from.Name, parent.Label, rule))
+	}
+
+	index, err := NewLabelIndex(to.Run.Graph)
+	if err != nil {
+		return append(reasons, err.Error())
+	}
+	i, ok := index[label]
+	if !ok {
+		return append(reasons, fmt.Sprintf("%s is not a node in %s", label, to.Name))
+	}
+	other := to.Run.Graph[i]
+	if step == 0 {
+		return append(reasons, fmt.Sprintf("%s is not a seed in %s", label, to.Name))
+	}
+
+	missing := false
+	if parent := activeParent(to.Run, other); parent == nil || to.Run.Step(parent) >= step {
+		missing = true
+		fromParent := activeParent(from.Run, node)
+		p, ok := index[fromParent.Label]
+		switch {
+		case !ok:
+			reasons = append(reasons, fmt.Sprintf("%s is not a node in %s", fromParent.Label, to.Name))
+		case !hasChild(to.Run.Graph[p], i):
+			reasons = append(reasons, fmt.Sprintf("edge %s -> %s is not in %s", fromParent.Label, label, to.Name))
+		default:
+			reasons = append(reasons, fmt.Sprintf("no parent of %s is active before step %d in %s", label, step, to.Name))
+		}
+	}
+	if strings.Join(node.Rule, " & ") != strings.Join(other.Rule, " & ") {
+		reasons = append(reasons, fmt.Sprintf("rule of %s is %q in %s and %q in %s", label,
+			strings.Join(node.Rule, " & "), from.Name, strings.Join(other.Rule, " & "), to.Name))
+	}
+	for _, r := range other.Rule {
+		if s := activationStep(to.Run, r); s == unreached || s >= step {
+			missing = true
+			reasons = append(reasons, fmt.Sprintf("rule of %s requires %s, not active before step %d in %s", label, r, step, to.Name))
+		}
+	}
+	if !missing {
+		reasons = append(reasons, fmt.Sprintf("%s has an active parent and a satisfied rule before step %d in %s, its engine missed the activation",
+			label, step, to.Name))
+	}
+	return reasons
+}
+
+// activeParent returns the parent of the node activated first in the run, or nil.
+func activeParent(r *Run, node *LabelNode) *LabelNode {
+	var parent *LabelNode
+	for _, p := range r.Graph {
+		if !hasChild(p, node.Id) {
+			continue
+		}
+		if _, ok := r.Actives[p.Label]; ok && (parent == nil || r.Step(p) < r.Step(parent)) {
+			parent = p
+		}
+	}
+	return parent
+}
+
+func hasChild(node *LabelNode, id int) bool {
+	for _, childId := range node.Children {
+		if childId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// runEngine runs the named engine over the graph from its first node.
+func runEngine(c *cli.Context, engine string, graph []*LabelNode) *Run {
+	bufferSize := c.Int("buffer")
+	if !c.IsSet("buffer") {
+		bufferSize = len(graph) * 10
+	}
+	opts := Options{Depth: c.Int("depth"), Workers: c.Int("routines"), BufferSize: bufferSize, BatchSize: c.Int("batch")}
+	run, err := simulateEngine(engine, graph, opts)
+	if err != nil {
+		log.Fatalf("%s: %v", c.Command.Name, err)
+	}
+	return run
+}
+
+func printChanges(name string, changes []Change) {
+	fmt.Printf("%s: %d\n", name, len(changes))
+	for _, change := range changes {
+		switch {
+		case change.Steps[0] == unreached:
+			fmt.Printf("  %s at step %d\n", change.Label, change.Steps[1])
+		case change.Steps[1] == unreached:
+			fmt.Printf("  %s at step %d\n", change.Label, change.Steps[0])
+		default:
+			fmt.Printf("  %s at step %d, then %d\n", change.Label, change.Steps[0], change.Steps[1])
+		}
+	}
+}
+
+// printDiff prints the changes from a to b and returns true if there are any. The
+// first divergence is only explained if the runs are over the graphs they ran on.
+func printDiff(a, b diffSide, explain bool) bool {
+	d := DiffRuns(a.Run, b.Run)
+	fmt.Printf("A: %s\nB: %s\n", a.Name, b.Name)
+	fmt.Printf("Num actives: %d, then %d\n", len(a.Run.Actives), len(b.Run.Actives))
+	printChanges("Gained", d.Gained)
+	printChanges("Lost", d.Lost)
+	printChanges("Changed step", d.Changed)
+
+	first := d.First()
+	if first == nil {
+		fmt.Println("No divergence")
+		return false
+	}
+	step := first.first()
+	fmt.Printf("First divergence: %s at step %d\n", first.Label, step)
+	if !explain {
+		return true
+	}
+	from, to := a, b
+	if first.Steps[0] != step {
+		from, to = b, a
+	}
+	for _, reason := range explainDivergence(from, to, first.Label, step) {
+		fmt.Printf("  %s\n", reason)
+	}
+	return true
+}
+
+func DiffCommand(c *cli.Context) {
+	inputs := c.StringSlice("input")
+	engines := c.StringSlice("engine")
+	if len(engines) == 0 {
+		engines = []string{"test"}
+	}
+	if len(inputs) == 0 || len(inputs) > 2 || len(engines) > 2 || len(inputs)+len(engines) != 3 {
+		log.Fatal("diff: give two inputs and an engine, or an input and two engines")
+	}
+	if len(inputs) == 1 {
+		inputs = append(inputs, inputs[0])
+	}
+	if len(engines) == 1 {
+		engines = append(engines, engines[0])
+	}
+
+	var sides [2]diffSide
+	for n := range sides {
+		graph := load(inputs[n])
+		if len(graph) == 0 {
+			log.Fatalf("diff: %s is empty", inputs[n])
+		}
+		sides[n] = diffSide{
+			Name: fmt.Sprintf("%s (%s)", inputs[n], engines[n]),
+			Run:  runEngine(c, engines[n], graph),
+		}
+	}
+	if sides[0].Run.Graph[0].Label != sides[1].Run.Graph[0].Label {
+		fmt.Printf("Seeds differ: %s, then %s\n", sides[0].Run.Graph[0].Label, sides[1].Run.Graph[0].Label)
+	}
+	if printDiff(sides[0], sides[1], true) && c.Bool("exit-code") {
+		os.Exit(1)
+	}
+}
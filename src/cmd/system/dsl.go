@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The knowledge graph language is a line oriented text format to write graphs by hand:
+//
+//  # Comments start with # and run to the end of the line.
+//  seed fever                    # the node activated by the simulations, the first node by default
+//  fever -> infection, flu       # edges from fever to infection and flu
+//  flu requires cough & fever    # flu is only activated if cough and fever are active, both must be nodes
+//  node rash                     # a node without edges
+//  include "symptoms.kg"         # the statements of another file, relative to this one
+//  namespace med {               # labels declared in the block are prefixed with med.
+//      cold -> .fever            # a leading dot refers to a label outside the namespace
+//  }
+//
+// Labels are made of letters, digits and the characters _ - . and can be quoted to use
+// any other character or a keyword as a label. Inside a namespace, labels without a
+// dot are prefixed with the namespace, labels containing a dot are absolute.
+// Nodes are numbered in the order they first appear, with the seed moved first.
+
+// SyntaxError is an error in a knowledge graph file at a line and column.
+type SyntaxError struct {
+	File string
+	Line int
+	Col  int
+	Msg  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.File, e.Line, e.Col, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenNewline
+	tokenName
+	tokenString
+	tokenArrow
+	tokenComma
+	tokenAmp
+	tokenLBrace
+	tokenRBrace
+)
+
+var tokenNames = map[tokenKind]string{
+	tokenEOF:     "end of file",
+	tokenNewline: "end of line",
+	tokenName:    "label",
+	tokenString:  "string",
+	tokenArrow:   "->",
+	tokenComma:   ",",
+	tokenAmp:     "&",
+	tokenLBrace:  "{",
+	tokenRBrace:  "}",
+}
+
+type token struct {
+	kind tokenKind
+	text string
+	line int
+	col  int
+}
+
+func (t token) String() string {
+	if t.kind == tokenName || t.kind == tokenString {
+		return strconv.Quote(t.text)
+	}
+	return tokenNames[t.kind]
+}
+
+type lexer struct {
+	file string
+	src  []byte
+	pos  int
+	line int
+	col  int
+}
+
+func isLabelRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+func (l *lexer) errorf(line, col int, format string, args ...interface{}) error {
+	return &SyntaxError{File: l.file, Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) peek() (rune, int) {
+	if l.pos >= len(l.src) {
+		return -1, 0
+	}
+	return utf8.DecodeRune(l.src[l.pos:])
+}
+
+func (l *lexer) advance(size int) {
+	if l.src[l.pos] == '\n' {
+		l.line++
+		l.col = 1
+	} else {
+		l.col++
+	}
+	l.pos += size
+}
+
+func (l *lexer) next() (token, error) {
+	for {
+		r, size := l.peek()
+		if r == '#' {
+			for r != '\n' && r != -1 {
+				l.advance(size)
+				r, size = l.peek()
+			}
+		}
+		if r == '\n' || r == -1 || !unicode.IsSpace(r) {
+			break
+		}
+		l.advance(size)
+	}
+
+	t := token{line: l.line, col: l.col}
+	r, size := l.peek()
+	switch {
+	case r == -1:
+		t.kind = tokenEOF
+	case r == '\n':
+		t.kind = tokenNewline
+		l.advance(size)
+	case r == ',':
+		t.kind = tokenComma
+		l.advance(size)
+	case r == '&':
+		t.kind = tokenAmp
+		l.advance(size)
+	case r == '{':
+		t.kind = tokenLBrace
+		l.advance(size)
+	case r == '}':
+		t.kind = tokenRBrace
+		l.advance(size)
+	case r == '-' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '>':
+		t.kind = tokenArrow
+		l.advance(1)
+		l.advance(1)
+	case r == '"':
+		start := l.pos
+		l.advance(size)
+		for {
+			r, size = l.peek()
+			if r == -1 || r == '\n' {
+				return t, l.errorf(t.line, t.col, "unterminated string")
+			}
+			l.advance(size)
+			if r == '\\' {
+				if _, size = l.peek(); size > 0 {
+					l.advance(size)
+				}
+				continue
+			}
+			if r == '"' {
+				break
+			}
+		}
+		text, err := strconv.Unquote(string(l.src[start:l.pos]))
+		if err != nil {
+			return t, l.errorf(t.line, t.col, "invalid string %s", l.src[start:l.pos])
+		}
+		t.kind = tokenString
+		t.text = text
+	case isLabelRune(r):
+		start := l.pos
+		for isLabelRune(r) {
+			// A label stops before an arrow: a->b is an edge.
+			if r == '-' && l.pos+1 < len(l.src) && l.src[l.pos+1] == '>' {
+				break
+			}
+			l.advance(size)
+			r, size = l.peek()
+		}
+		t.kind = tokenName
+		t.text = string(l.src[start:l.pos])
+	default:
+		return t, l.errorf(t.line, t.col, "unexpected character %q", r)
+	}
+	return t, nil
+}
+
+// dslCompiler builds a graph from the statements of one or more files.
+type dslCompiler struct {
+	*graphBuilder
+	ruleSet  map[int]token
+	ruleFile map[int]string
+	seed     string
+	seedAt   token
+	seedFile string
+	included map[string]bool
+	stack    []string
+}
+
+// parser parses the statements of a single file.
+type parser struct {
+	*dslCompiler
+	lex        *lexer
+	tok        token
+	namespaces []string
+}
+
+// compileDSL compiles a knowledge graph file, and the files it includes, to a graph.
+func compileDSL(inputFile string) ([]*LabelNode, error) {
+	c := &dslCompiler{
+		graphBuilder: newGraphBuilder(),
+		ruleSet:      make(map[int]token),
+		ruleFile:     make(map[int]string),
+		included:     make(map[string]bool),
+	}
+	if err := c.compileFile(inputFile, nil); err != nil {
+		return nil, err
+	}
+	if _, ok := c.index[c.seed]; c.seed != "" && !ok {
+		return nil, &SyntaxError{File: c.seedFile, Line: c.seedAt.line, Col: c.seedAt.col, Msg: fmt.Sprintf("seed %q is not a node", c.seed)}
+	}
+	// The labels of a rule can be declared after it, they are checked once all the
+	// nodes are known.
+	for i, node := range c.graph {
+		at, ok := c.ruleSet[i]
+		if !ok {
+			continue
+		}
+		for _, label := range node.Rule {
+			if _, ok := c.index[label]; !ok {
+				return nil, &SyntaxError{File: c.ruleFile[i], Line: at.line, Col: at.col, Msg: fmt.Sprintf("rule of %s requires %q, which is not a node", node.Label, label)}
+			}
+		}
+	}
+	return c.build(c.seed)
+}
+
+func (c *dslCompiler) compileFile(inputFile string, namespaces []string) error {
+	abs, err := filepath.Abs(inputFile)
+	if err != nil {
+		return err
+	}
+	for _, f := range c.stack {
+		if f == abs {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(c.stack, abs), " -> "))
+		}
+	}
+	// A file included twice in the same namespace would only repeat its statements.
+	key := abs + "\x00" + strings.Join(namespaces, ".")
+	if c.included[key] {
+		return nil
+	}
+	c.included[key] = true
+
+	src, err := ioutil.ReadFile(inputFile)
+	if err != nil {
+		return err
+	}
+	c.stack = append(c.stack, abs)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+
+	p := &parser{
+		dslCompiler: c,
+		lex:         &lexer{file: inputFile, src: src, line: 1, col: 1},
+		namespaces:  namespaces,
+	}
+	return p.parse()
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return p.lex.errorf(t.line, t.col, format, args...)
+}
+
+func (p *parser) next() error {
+	t, err := p.lex.next()
+	p.tok = t
+	return err
+}
+
+func (p *parser) expect(kind tokenKind) (token, error) {
+	t := p.tok
+	if t.kind != kind {
+		return t, p.errorf(t, "expected %s, found %s", tokenNames[kind], t)
+	}
+	return t, p.next()
+}
+
+// label parses a label and qualifies it with the current namespace.
+func (p *parser) label() (string, error) {
+	t := p.tok
+	if t.kind != tokenName && t.kind != tokenString {
+		return "", p.errorf(t, "expected label, found %s", t)
+	}
+	if err := p.next(); err != nil {
+		return "", err
+	}
+	label := t.text
+	switch {
+	case label == "" || label == ".":
+		return "", p.errorf(t, "empty label")
+	case strings.HasPrefix(label, "."):
+		return label[1:], nil
+	case strings.Contains(label, ".") || len(p.namespaces) == 0:
+		return label, nil
+	}
+	return strings.Join(p.namespaces, ".") + "." + label, nil
+}
+
+// labels parses a list of labels separated by sep.
+func (p *parser) labels(sep tokenKind) ([]string, error) {
+	var labels []string
+	for {
+		label, err := p.label()
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+		if p.tok.kind != sep {
+			return labels, nil
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *parser) endOfStatement() error {
+	if p.tok.kind == tokenEOF || p.tok.kind == tokenRBrace {
+		return nil
+	}
+	_, err := p.expect(tokenNewline)
+	return err
+}
+
+func (p *parser) parse() error {
+	if err := p.next(); err != nil {
+		return err
+	}
+	depth := len(p.namespaces)
+	var blocks []token
+	for {
+		t := p.tok
+		switch {
+		case t.kind == tokenEOF:
+			if len(blocks) > 0 {
+				open := blocks[len(blocks)-1]
+				return p.errorf(open, "namespace %s is not closed", p.namespaces[len(p.namespaces)-1])
+			}
+			return nil
+
+		case t.kind == tokenNewline:
+			if err := p.next(); err != nil {
+				return err
+			}
+			continue
+
+		case t.kind == tokenRBrace:
+			if len(p.namespaces) == depth {
+				return p.errorf(t, "unexpected }")
+			}
+			p.namespaces = p.namespaces[:len(p.namespaces)-1]
+			blocks = blocks[:len(blocks)-1]
+			if err := p.next(); err != nil {
+				return err
+			}
+
+		case t.kind == tokenName && t.text == "include":
+			if err := p.next(); err != nil {
+				return err
+			}
+			path, err := p.expect(tokenString)
+			if err != nil {
+				return err
+			}
+			name := path.text
+			if !filepath.IsAbs(name) {
+				name = filepath.Join(filepath.Dir(p.lex.file), name)
+			}
+			if err := p.compileFile(name, append([]string(nil), p.namespaces...)); err != nil {
+				if _, ok := err.(*SyntaxError); ok {
+					return err
+				}
+				return p.errorf(path, "%v", err)
+			}
+
+		case t.kind == tokenName && t.text == "namespace":
+			if err := p.next(); err != nil {
+				return err
+			}
+			name, err := p.expect(tokenName)
+			if err != nil {
+				return err
+			}
+			if strings.Contains(name.text, ".") {
+				return p.errorf(name, "namespace %s cannot contain a dot", name.text)
+			}
+			if _, err := p.expect(tokenLBrace); err != nil {
+				return err
+			}
+			p.namespaces = append(p.namespaces, name.text)
+			blocks = append(blocks, t)
+			continue
+
+		case t.kind == tokenName && t.text == "seed":
+			if err := p.next(); err != nil {
+				return err
+			}
+			at := p.tok
+			label, err := p.label()
+			if err != nil {
+				return err
+			}
+			if p.seed != "" && p.seed != label {
+				return p.errorf(at, "seed already set to %s at %d:%d", p.seed, p.seedAt.line, p.seedAt.col)
+			}
+			p.seed, p.seedAt, p.seedFile = label, at, p.lex.file
+
+		case t.kind == tokenName && t.text == "node":
+			if err := p.next(); err != nil {
+				return err
+			}
+			labels, err := p.labels(tokenComma)
+			if err != nil {
+				return err
+			}
+			for _, label := range labels {
+				p.node(label)
+			}
+
+		default:
+			label, err := p.label()
+			if err != nil {
+				return err
+			}
+			parent := p.node(label)
+			switch {
+			case p.tok.kind == tokenArrow:
+				if err := p.next(); err != nil {
+					return err
+				}
+				children, err := p.labels(tokenComma)
+				if err != nil {
+					return err
+				}
+				for _, child := range children {
+					p.edge(parent, p.node(child))
+				}
+			case p.tok.kind == tokenName && p.tok.text == "requires":
+				if err := p.next(); err != nil {
+					return err
+				}
+				rule, err := p.labels(tokenAmp)
+				if err != nil {
+					return err
+				}
+				if prev, ok := p.ruleSet[parent]; ok {
+					return p.errorf(t, "%s already has a rule, set at %d:%d", label, prev.line, prev.col)
+				}
+				p.ruleSet[parent] = t
+				p.ruleFile[parent] = p.lex.file
+				p.graph[parent].Rule = rule
+			default:
+				return p.errorf(p.tok, "expected -> or requires after %s, found %s", label, p.tok)
+			}
+		}
+		if err := p.endOfStatement(); err != nil {
+			return err
+		}
+	}
+}
+
+// quoteLabel writes a label as it must appear in a knowledge graph file. Labels are
+// written absolute since decompiled files have no namespaces.
+func quoteLabel(label string) string {
+	// The leading dot of a label refers to the root namespace and is removed.
+	if strings.HasPrefix(label, ".") {
+		label = "." + label
+	}
+	switch label {
+	case "", "include", "namespace", "seed", "node", "requires":
+		return strconv.Quote(label)
+	}
+	for i, r := range label {
+		if !isLabelRune(r) || strings.HasPrefix(label[i:], "->") {
+			return strconv.Quote(label)
+		}
+	}
+	return label
+}
+
+// decompileDSL writes the graph in the knowledge graph language.
+func decompileDSL(graph []*LabelNode) []byte {
+	var buf bytes.Buffer
+	if len(graph) == 0 {
+		return buf.Bytes()
+	}
+	fmt.Fprintf(&buf, "# graph %s\nseed %s\n\n", GraphHash(graph), quoteLabel(graph[0].Label))
+
+	isChild := make([]bool, len(graph))
+	for _, node := range graph {
+		for _, childId := range node.Children {
+			isChild[childId] = true
+		}
+	}
+	for i, node := range graph {
+		if len(node.Children) > 0 {
+			children := make([]string, len(node.Children))
+			for j, childId := range node.Children {
+				children[j] = quoteLabel(graph[childId].Label)
+			}
+			fmt.Fprintf(&buf, "%s -> %s\n", quoteLabel(node.Label), strings.Join(children, ", "))
+		}
+		if len(node.Rule) > 0 {
+			rule := make([]string, len(node.Rule))
+			for j, label := range node.Rule {
+				rule[j] = quoteLabel(label)
+			}
+			fmt.Fprintf(&buf, "%s requires %s\n", quoteLabel(node.Label), strings.Join(rule, " & "))
+		}
+		if len(node.Children) == 0 && len(node.Rule) == 0 && !isChild[i] {
+			fmt.Fprintf(&buf, "node %s\n", quoteLabel(node.Label))
+		}
+	}
+	return buf.Bytes()
+}
+
+func CompileGraph(c *cli.Context) {
+	graph, err := compileDSL(c.String("input"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Graph Size: %d\n", len(graph))
+	outputGraph(c, graph, map[string]string{"size": strconv.Itoa(len(graph))})
+}
+
+func DecompileGraph(c *cli.Context) {
+	graph := load(c.String("input"))
+	outputFile := writeOutput(c, decompileDSL(graph), map[string]string{"size": strconv.Itoa(len(graph))})
+	fmt.Printf("Graph written to %s\n", outputFile)
+}
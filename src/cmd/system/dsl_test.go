@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecompileRoundTrip(t *testing.T) {
+	dead, err := compileDSL("testdata/dead.kg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	graphs := map[string][]*LabelNode{
+		"single node": {{Id: 0, Label: "a"}},
+		"dead.kg":     dead,
+		"random":      generateRandomTreeWithRules(4, 1000, 1),
+	}
+	for name, graph := range graphs {
+		file := filepath.Join(t.TempDir(), "graph.kg")
+		if err := ioutil.WriteFile(file, decompileDSL(graph), 0644); err != nil {
+			t.Fatal(err)
+		}
+		compiled, err := compileDSL(file)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		// The nodes are numbered as they are first written in the file.
+		if GraphHash(renumber(compiled, labelOrder(compiled))) != GraphHash(renumber(graph, labelOrder(graph))) {
+			t.Errorf("%s: decompiled graph compiles to a different graph", name)
+		}
+	}
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are the settings of a simulation. An engine ignores the ones it does not use.
+type Options struct {
+	Depth int
+	// Workers is the number of goroutines of the engine.
+	Workers int
+	// BufferSize is the size of the channels between the goroutines of the engine and
+	// BatchSize the number of nodes sent at once over them.
+	BufferSize int
+	BatchSize  int
+}
+
+// Engine is a strategy to run the test simulation over a graph from its first node.
+type Engine interface {
+	Simulate(graph []*LabelNode, opts Options) *Run
+	// Uses tells if the option other than Depth changes how the engine runs: workers,
+	// buffer or batch.
+	Uses(option string) bool
+	// Steps tells how the engine numbers the steps of the activations, which Verify
+	// checks.
+	Steps() Steps
+}
+
+// Steps is how an engine numbers the steps of the activations.
+type Steps int
+
+const (
+	// ParentSteps activate a node at the step after a parent, at most at the depth.
+	// The rule is checked when a parent reaches the node, its labels can have been
+	// activated since at a higher step, they only have to be active.
+	ParentSteps Steps = iota
+	// PassSteps count the passes over the actives. A node activated during a pass can
+	// be expanded in the same pass, so the steps are not limited by the depth.
+	PassSteps
+	// ClosureSteps are the steps computed by Closure, in the order of the
+	// activations: the labels of the rule of a node are active at an earlier step.
+	ClosureSteps
+)
+
+// engines are the engines by name, see RegisterEngine.
+var engines = make(map[string]Engine)
+
+// RegisterEngine makes the engine available to the run, diff and bench commands
+// under the name.
+func RegisterEngine(name string, engine Engine) {
+	if _, ok := engines[name]; ok {
+		panic(fmt.Sprintf("engine %q registered twice", name))
+	}
+	engines[name] = engine
+}
+
+func engineNames() []string {
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupEngine(name string) (Engine, error) {
+	engine, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown engine %q, use %s", name, strings.Join(engineNames(), ", "))
+	}
+	return engine, nil
+}
+
+// simulateEngine runs the named engine over the graph from its first node.
+func simulateEngine(name string, graph []*LabelNode, opts Options) (*Run, error) {
+	engine, err := lookupEngine(name)
+	if err != nil {
+		return nil, err
+	}
+	return engine.Simulate(graph, opts), nil
+}
+
+func init() {
+	RegisterEngine("test", sequentialEngine{})
+	RegisterEngine("sequential", sequentialEngine{})
+	RegisterEngine("concurrent", concurrentEngine{newChannelTransport})
+	RegisterEngine("concurrent-ring", concurrentEngine{newRingTransport})
+	RegisterEngine("parallel", parallelEngine{})
+	RegisterEngine("closure", closureEngine{})
+}
+
+type sequentialEngine struct{}
+
+func (sequentialEngine) Simulate(graph []*LabelNode, opts Options) *Run {
+	return Simulate(graph, opts.Depth)
+}
+
+func (sequentialEngine) Uses(option string) bool { return false }
+
+func (sequentialEngine) Steps() Steps { return PassSteps }
+
+// concurrentEngine is the concurrent simulation with channels between its goroutines,
+// or another transport of the batches of nodes of the buffer size.
+type concurrentEngine struct {
+	newTransport func(bufferSize int) transport
+}
+
+func (e concurrentEngine) Simulate(graph []*LabelNode, opts Options) *Run {
+	return simulateConcurrent(graph, opts.Depth, opts.Workers, opts.BatchSize,
+		e.newTransport(opts.BufferSize), e.newTransport(opts.BufferSize))
+}
+
+func (concurrentEngine) Uses(option string) bool { return true }
+
+func (concurrentEngine) Steps() Steps { return ParentSteps }
+
+type parallelEngine struct{}
+
+func (parallelEngine) Simulate(graph []*LabelNode, opts Options) *Run {
+	return SimulateParallel(graph, opts.Depth, opts.Workers)
+}
+
+func (parallelEngine) Uses(option string) bool { return option == "workers" }
+
+func (parallelEngine) Steps() Steps { return ParentSteps }
+
+// closureEngine is the deterministic activation used by the incremental updates.
+type closureEngine struct{}
+
+func (closureEngine) Simulate(graph []*LabelNode, opts Options) *Run {
+	return NewActivity(graph, []string{graph[0].Label}).Run(opts.Depth)
+}
+
+func (closureEngine) Uses(option string) bool { return false }
+
+func (closureEngine) Steps() Steps { return ClosureSteps }
+
+// simulationFlags are the flags of the commands running a simulation with
+// runSimulation, with the flags of their engines in between and the profiling flags
+// last.
+func simulationFlags(engineFlags ...cli.Flag) []cli.Flag {
+	flags := []cli.Flag{
+		cli.IntFlag{
+			Name:   "depth, d",
+			Value:  100,
+			Usage:  "The depth for each simulation run",
+			EnvVar: "SIM_DEPTH",
+		},
+		cli.IntFlag{
+			Name:   "size, s",
+			Value:  100,
+			Usage:  "The size of the graph for the simulation run. If input is set, this setting is ignored.",
+			EnvVar: "SIM_SIZE",
+		},
+	}
+	flags = append(flags, engineFlags...)
+	flags = append(flags,
+		cli.StringFlag{
+			Name:  "input, i",
+			Value: "./data/data.json",
+			Usage: "Path to json file containing data set. If not set, a random data set is used.",
+		},
+		cli.StringFlag{
+			Name:  "output, o",
+			Value: "./data/{seed}.json",
+			Usage: "Path to output json of data set used. " + outputUsage,
+		},
+		cli.BoolFlag{
+			Name:  "force, f",
+			Usage: "Replace output if it already exists.",
+		},
+		cli.StringFlag{
+			Name:  "result",
+			Value: "./results/{command}-{timestamp}.json",
+			Usage: "Path to output json of the result of the simulation, see the result command. " + outputUsage,
+		},
+	)
+	return append(flags, profileFlags...)
+}
+
+// simulationAction returns the action of a command running the named engine.
+func simulationAction(engine string) func(*cli.Context) {
+	return func(c *cli.Context) {
+		runSimulation(c, engine)
+	}
+}
+
+// RunSimulation runs the engine given by the engine flag.
+func RunSimulation(c *cli.Context) {
+	runSimulation(c, c.String("engine"))
+}
+
+// runSimulation loads the graph given by the input flag, or generates one, runs the
+// named engine over it from its first node and reports the time taken, excluding
+// setup. The engine is picked by autoEngine if it is auto.
+func runSimulation(c *cli.Context, name string) {
+	var graph []*LabelNode
+
+	depth := c.Int("depth")
+	size := c.Int("size")
+
+	// Values of the placeholders of the output path
+	vars := make(map[string]string)
+	profiles := newProfiles(c)
+
+	if c.IsSet("input") {
+		graph = load(c.String("input"))
+		size = len(graph)
+		fmt.Println("Graph Loaded")
+	} else {
+		seed := time.Now().UnixNano()
+		//graph = generateRandomGraph(size, seed)
+		graph = generateRandomTreeWithRules(4, size, seed)
+		size = len(graph)
+		vars["seed"] = strconv.FormatInt(seed, 10)
+		fmt.Println("Graph generated")
+	}
+	if size == 0 {
+		log.Fatalf("%s: the graph is empty", c.Command.Name)
+	}
+	vars["size"] = strconv.Itoa(size)
+	if c.IsSet("procs") {
+		runtime.GOMAXPROCS(c.Int("procs"))
+	}
+
+	opts := Options{
+		Depth:      depth,
+		Workers:    c.Int("workers"),
+		BufferSize: c.Int("buffer"),
+		BatchSize:  c.Int("batch"),
+	}
+	if !c.IsSet("buffer") {
+		opts.BufferSize = size * 10
+	}
+	if name == "auto" {
+		name = autoOptions(c, graph, &opts)
+	}
+	engine, err := lookupEngine(name)
+	if err != nil {
+		log.Fatalf("%s: %v", c.Command.Name, err)
+	}
+
+	fmt.Printf("Simulation Info:\nEngine: %s\nDepth: %d\nGraph Size: %d\nGraph Hash: %s\nNum of Cores: %d\nGOMAXPROCS: %d\n",
+		name, depth, size, GraphHash(graph), runtime.NumCPU(), runtime.GOMAXPROCS(-1))
+	if engine.Uses("workers") {
+		fmt.Printf("Workers: %d\n", opts.Workers)
+	}
+	if engine.Uses("buffer") {
+		fmt.Printf("Buffer Size: %d\n", opts.BufferSize)
+	}
+	if engine.Uses("batch") {
+		fmt.Printf("Batch Size: %d\n", opts.BatchSize)
+	}
+
+	profiles.start()
+	start := time.Now()
+	run := engine.Simulate(graph, opts)
+	elapsed := time.Since(start)
+	profiles.stop()
+	fmt.Printf("Num actives: %d\n", len(run.Actives))
+	fmt.Printf("Time taken: %s\n", elapsed)
+	if c.IsSet("output") {
+		outputGraph(c, graph, vars)
+	}
+	if c.IsSet("result") {
+		result := NewResult(graph, run, name, []string{graph[0].Label}, depth, start, elapsed)
+		if c.IsSet("input") {
+			result.Input = c.String("input")
+		}
+		if engine.Uses("workers") {
+			result.Workers = opts.Workers
+		}
+		if engine.Uses("buffer") {
+			result.BufferSize = opts.BufferSize
+		}
+		if engine.Uses("batch") {
+			result.BatchSize = opts.BatchSize
+		}
+		outputResult(c, result, vars)
+	}
+}
+
+// CheckEngine runs an engine over a graph many times, each run within a timeout, to
+// catch the races between its goroutines that only show once in a while, such as a
+// worker waiting while it holds nodes that are never sent.
+// checkEngine runs the engine over the graph runs times, and returns an error for the
+// first run that does not finish within timeout or activates no node.
+func checkEngine(engine Engine, graph []*LabelNode, opts Options, runs int, timeout time.Duration) error {
+	for n := 1; n <= runs; n++ {
+		finished := make(chan *Run, 1)
+		go func() {
+			finished <- engine.Simulate(graph, opts)
+		}()
+		select {
+		case run := <-finished:
+			if len(run.Actives) == 0 {
+				return fmt.Errorf("run %d activated no node", n)
+			}
+		case <-time.After(timeout):
+			return fmt.Errorf("run %d did not finish within %s", n, timeout)
+		}
+	}
+	return nil
+}
+
+// CheckEngine checks the engine with the options of the flags, then with buffers of
+// a single batch of a single node for the engines using buffers, where the goroutines
+// most often find no room to send.
+func CheckEngine(c *cli.Context) {
+	name := c.String("engine")
+	engine, err := lookupEngine(name)
+	if err != nil {
+		log.Fatalf("check-engine: %v", err)
+	}
+	var graph []*LabelNode
+	if c.IsSet("input") {
+		graph = load(c.String("input"))
+	} else {
+		graph = generateRandomTreeWithRules(4, c.Int("size"), int64(c.Int("seed")))
+	}
+	opts := Options{Depth: c.Int("depth"), Workers: c.Int("workers"), BufferSize: c.Int("buffer"), BatchSize: c.Int("batch")}
+	if !c.IsSet("buffer") {
+		opts.BufferSize = len(graph) * 10
+	}
+	cases := []Options{opts}
+	if smallest := (Options{opts.Depth, opts.Workers, 1, 1}); engine.Uses("buffer") && opts != smallest {
+		cases = append(cases, smallest)
+	}
+	runs, timeout := c.Int("runs"), c.Duration("timeout")
+	fmt.Printf("Engine: %s\nGraph Size: %d\nWorkers: %d\nRuns: %d\nTimeout: %s\n",
+		name, len(graph), opts.Workers, runs, timeout)
+	for _, opts := range cases {
+		fmt.Printf("Buffer Size: %d\nBatch Size: %d\n", opts.BufferSize, opts.BatchSize)
+		if err := checkEngine(engine, graph, opts, runs, timeout); err != nil {
+			fmt.Printf("Check failed: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Printf("All %d runs finished\n", runs*len(cases))
+}
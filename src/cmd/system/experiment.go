@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Experiment is a sweep of simulations over every combination of its graphs, engines,
+// depths, routines, buffer and batch sizes, each run Repetitions times. The options
+// an engine does not use are not varied for it. It is read from a JSON or YAML file:
+//
+//	name: scaling
+//	datasets: [data/100.json, data/1000.json]
+//	generators:
+//	  - type: rules
+//	    sizes: [10000, 100000]
+//	engines: [sequential, concurrent, parallel]
+//	depths: [100]
+//	routines: [1, 2, 4]
+//	buffers: [0]        # 0 scales the buffer to the graph, size * 10
+//	batches: [1, 64]
+//	repetitions: 3
+//	sweeps:
+//	  - sizes: [10000]
+//	  - sizes: [100000]
+//	    depths: [10, 100]
+//	    repetitions: 1
+//
+// If it has Sweeps, the combinations are those of each of its sweeps instead, a run
+// common to several sweeps being run once.
+type Experiment struct {
+	Name string
+	// Datasets are graph files, relative to the experiment file.
+	Datasets   []string
+	Generators []Generator
+	Engines    []string
+	Depths     []int
+	Routines   []int
+	Buffers    []int
+	Batches    []int
+	// Repetitions is the number of times each combination is run.
+	Repetitions int
+	Sweeps      []Sweep
+}
+
+// Sweep is a part of the combinations of an experiment: the ones of the graphs of its
+// Sizes, generated or read, with its engines, depths, routines, buffer and batch sizes
+// and repetitions. The fields it does not set are the ones of the experiment.
+type Sweep struct {
+	Sizes       []int
+	Engines     []string
+	Depths      []int
+	Routines    []int
+	Buffers     []int
+	Batches     []int
+	Repetitions int
+}
+
+// Generator generates a graph of each size with the seed. Type is rules for
+// generateRandomTreeWithRules, tree for generateRandomTree or random for
+// generateRandomGraph.
+type Generator struct {
+	Type      string
+	Branching int
+	Sizes     []int
+	Seed      int64
+}
+
+// readExperiment reads an experiment file, as YAML if its extension is .yaml or .yml
+// and as JSON otherwise, and fills in the defaults.
+func readExperiment(file string) (*Experiment, []byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	jsonData := data
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".yaml", ".yml":
+		v, err := parseYAML(file, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if jsonData, err = json.Marshal(v); err != nil {
+			return nil, nil, err
+		}
+	}
+	e := new(Experiment)
+	if err := json.Unmarshal(jsonData, e); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := e.check(); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if e.Name == "" {
+		e.Name = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	}
+	for i, dataset := range e.Datasets {
+		if !filepath.IsAbs(dataset) {
+			e.Datasets[i] = filepath.Join(filepath.Dir(file), dataset)
+		}
+	}
+	return e, data, nil
+}
+
+// check checks the experiment and fills in the defaults: a depth of 100, 5
+// routines, buffers scaled to the graphs, batches of 64 and one repetition.
+func (e *Experiment) check() error {
+	if len(e.Datasets) == 0 && len(e.Generators) == 0 {
+		return fmt.Errorf("no datasets or generators")
+	}
+	if len(e.Engines) == 0 {
+		return fmt.Errorf("no engines")
+	}
+	for _, engine := range e.Engines {
+		if _, err := lookupEngine(engine); err != nil {
+			return err
+		}
+	}
+	for _, sweep := range e.Sweeps {
+		for _, engine := range sweep.Engines {
+			if _, err := lookupEngine(engine); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range e.Generators {
+		g := &e.Generators[i]
+		if g.Type == "" {
+			g.Type = "rules"
+		}
+		if g.Type != "rules" && g.Type != "tree" && g.Type != "random" {
+			return fmt.Errorf("unknown generator type %q, use rules, tree or random", g.Type)
+		}
+		if g.Branching == 0 {
+			g.Branching = 4
+		}
+		if len(g.Sizes) == 0 {
+			return fmt.Errorf("generator %d has no sizes", i+1)
+		}
+	}
+	if len(e.Depths) == 0 {
+		e.Depths = []int{100}
+	}
+	if len(e.Routines) == 0 {
+		e.Routines = []int{5}
+	}
+	if len(e.Buffers) == 0 {
+		e.Buffers = []int{0}
+	}
+	if len(e.Batches) == 0 {
+		e.Batches = []int{64}
+	}
+	if e.Repetitions == 0 {
+		e.Repetitions = 1
+	}
+	return nil
+}
+
+// experimentGraph is a graph of an experiment, with the name its runs are named by.
+type experimentGraph struct {
+	name  string
+	input string
+	graph []*LabelNode
+	// size is the size the graph was generated with, or the size of a dataset.
+	size int
+}
+
+// graphs loads the datasets and generates the graphs of the experiment. As the labels
+// of the generated graphs are random, a generated graph is written to the graphs
+// directory of dir the first time and read from it when the experiment is resumed.
+func (e *Experiment) graphs(dir string) ([]experimentGraph, error) {
+	var graphs []experimentGraph
+	names := make(map[string]bool)
+	add := func(g experimentGraph) error {
+		if names[g.name] {
+			return fmt.Errorf("two graphs are named %s", g.name)
+		}
+		names[g.name] = true
+		graphs = append(graphs, g)
+		return nil
+	}
+
+	for _, dataset := range e.Datasets {
+		graph, err := readGraph(dataset)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(dataset), filepath.Ext(dataset))
+		if err := add(experimentGraph{name, dataset, graph, len(graph)}); err != nil {
+			return nil, err
+		}
+	}
+	for _, g := range e.Generators {
+		for _, size := range g.Sizes {
+			name := fmt.Sprintf("%s-%d-%d", g.Type, size, g.Seed)
+			file := filepath.Join(dir, "graphs", name+".json")
+			graph, err := readGraph(file)
+			if os.IsNotExist(err) {
+				switch g.Type {
+				case "rules":
+					graph = generateRandomTreeWithRules(g.Branching, size, g.Seed)
+				case "tree":
+					graph = generateRandomTree(g.Branching, size, g.Seed)
+				case "random":
+					graph = generateRandomGraph(size, g.Seed)
+				}
+				err = writeGraph(graph, file, false, false)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := add(experimentGraph{name, file, graph, size}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return graphs, nil
+}
+
+// experimentRun is a run of a sweep.
+type experimentRun struct {
+	graph      *experimentGraph
+	engine     string
+	opts       Options
+	repetition int
+}
+
+// name names the run by its graph, engine, the options the engine uses and its
+// repetition, such as 1000-concurrent-d100-r4-b0-n64-1.
+func (r experimentRun) name() string {
+	return fmt.Sprintf("%s-%s-%d", r.graph.name, optionsName(r.engine, r.opts), r.repetition)
+}
+
+// optionsName names a configuration by its engine and the options the engine uses,
+// such as concurrent-d100-r4-b0-n64.
+func optionsName(engine string, opts Options) string {
+	name := fmt.Sprintf("%s-d%d", engine, opts.Depth)
+	e := engines[engine]
+	if e.Uses("workers") {
+		name += fmt.Sprintf("-r%d", opts.Workers)
+	}
+	if e.Uses("buffer") {
+		name += fmt.Sprintf("-b%d", opts.BufferSize)
+	}
+	if e.Uses("batch") {
+		name += fmt.Sprintf("-n%d", opts.BatchSize)
+	}
+	return name
+}
+
+// runs lists the runs of the sweeps over the graphs, in the order they are run.
+func (e *Experiment) runs(graphs []experimentGraph) []experimentRun {
+	sweeps := e.Sweeps
+	if len(sweeps) == 0 {
+		sweeps = []Sweep{{}}
+	}
+	var runs []experimentRun
+	names := make(map[string]bool)
+	for _, sweep := range sweeps {
+		for _, r := range e.sweep(sweep).grid(graphs, sweep.Sizes) {
+			if !names[r.name()] {
+				names[r.name()] = true
+				runs = append(runs, r)
+			}
+		}
+	}
+	return runs
+}
+
+// sweep returns the experiment with the fields set by the sweep.
+func (e *Experiment) sweep(s Sweep) *Experiment {
+	sweep := *e
+	if len(s.Engines) > 0 {
+		sweep.Engines = s.Engines
+	}
+	if len(s.Depths) > 0 {
+		sweep.Depths = s.Depths
+	}
+	if len(s.Routines) > 0 {
+		sweep.Routines = s.Routines
+	}
+	if len(s.Buffers) > 0 {
+		sweep.Buffers = s.Buffers
+	}
+	if len(s.Batches) > 0 {
+		sweep.Batches = s.Batches
+	}
+	if s.Repetitions > 0 {
+		sweep.Repetitions = s.Repetitions
+	}
+	return &sweep
+}
+
+// grid lists the runs of every combination over the graphs of the sizes, or over all
+// the graphs if sizes is empty.
+func (e *Experiment) grid(graphs []experimentGraph, sizes []int) []experimentRun {
+	selected := make(map[int]bool)
+	for _, size := range sizes {
+		selected[size] = true
+	}
+	var runs []experimentRun
+	for i := range graphs {
+		if len(sizes) > 0 && !selected[graphs[i].size] {
+			continue
+		}
+		for _, name := range e.Engines {
+			engine := engines[name]
+			routines, buffers, batches := e.Routines, e.Buffers, e.Batches
+			if !engine.Uses("workers") {
+				routines = []int{0}
+			}
+			if !engine.Uses("buffer") {
+				buffers = []int{0}
+			}
+			if !engine.Uses("batch") {
+				batches = []int{0}
+			}
+			for _, depth := range e.Depths {
+				for _, workers := range routines {
+					for _, buffer := range buffers {
+						for _, batch := range batches {
+							for rep := 1; rep <= e.Repetitions; rep++ {
+								runs = append(runs, experimentRun{
+									graph:      &graphs[i],
+									engine:     name,
+									opts:       Options{Depth: depth, Workers: workers, BufferSize: buffer, BatchSize: batch},
+									repetition: rep,
+								})
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return runs
+}
+
+// copyExperiment copies the experiment file to dir. If the experiment was already
+// started in dir, the copy must be the same file so that the results of a resumed
+// sweep all come from the same configuration.
+func copyExperiment(file string, data []byte, dir string) error {
+	copyFile := filepath.Join(dir, filepath.Base(file))
+	previous, err := ioutil.ReadFile(copyFile)
+	if os.IsNotExist(err) {
+		return writeFileAtomic(copyFile, data, 0644)
+	}
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(previous, data) {
+		return fmt.Errorf("%s was started with another configuration, see %s", dir, copyFile)
+	}
+	return nil
+}
+
+func ExperimentRun(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("experiment run: give an experiment file")
+	}
+	file := c.Args()[0]
+	e, data, err := readExperiment(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dir := c.String("dir")
+	if dir == "" {
+		dir = filepath.Join("results", e.Name)
+	}
+	for _, sub := range []string{"graphs", "runs"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := copyExperiment(file, data, dir); err != nil {
+		log.Fatalf("experiment run: %v", err)
+	}
+	profiles := newProfiles(c)
+	graphs, err := e.graphs(dir)
+	if err != nil {
+		log.Fatalf("experiment run: %v", err)
+	}
+	runs := e.runs(graphs)
+
+	fmt.Printf("Experiment Info:\nName: %s\nResults: %s\nGraphs: %d\nRuns: %d\nNum of Cores: %d\nGOMAXPROCS: %d\n",
+		e.Name, dir, len(graphs), len(runs), runtime.NumCPU(), runtime.GOMAXPROCS(-1))
+	done := 0
+	profiles.start()
+	for n, r := range runs {
+		resultFile := filepath.Join(dir, "runs", r.name()+".json")
+		if _, err := os.Stat(resultFile); err == nil {
+			done++
+			continue
+		}
+		opts := r.opts
+		if opts.BufferSize == 0 && engines[r.engine].Uses("buffer") {
+			opts.BufferSize = len(r.graph.graph) * 10
+		}
+
+		runtime.GC()
+		start := time.Now()
+		run := engines[r.engine].Simulate(r.graph.graph, opts)
+		elapsed := time.Since(start)
+
+		result := NewResult(r.graph.graph, run, r.engine, []string{r.graph.graph[0].Label}, opts.Depth, start, elapsed)
+		result.Input = r.graph.input
+		result.Workers, result.BufferSize, result.BatchSize = opts.Workers, opts.BufferSize, opts.BatchSize
+		b, err := json.MarshalIndent(result, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Written atomically so that an interrupted sweep never leaves a partial result
+		// that would be skipped when resumed.
+		if err := writeFileAtomic(resultFile, b, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("[%d/%d] %s: %d actives in %s\n", n+1, len(runs), r.name(), len(run.Actives), elapsed)
+	}
+	profiles.stop()
+	if done > 0 {
+		fmt.Printf("Resumed: %d runs were already done\n", done)
+	}
+	fmt.Printf("Results written to %s\n", filepath.Join(dir, "runs"))
+}
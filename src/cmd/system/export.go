@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"log"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// exportView is the part of a graph being exported, optionally overlaid with the
+// steps at which its nodes were activated by a run.
+type exportView struct {
+	graph    []*LabelNode
+	hash     string
+	nodes    []int
+	included []bool
+	index    LabelIndex
+
+	// steps is nil if no run is overlaid, inactive nodes are unreached.
+	steps   []int
+	maxStep int
+}
+
+func newExportView(graph []*LabelNode) (*exportView, error) {
+	index, err := NewLabelIndex(graph)
+	if err != nil {
+		return nil, err
+	}
+	v := &exportView{
+		graph:    graph,
+		hash:     GraphHash(graph),
+		index:    index,
+		included: make([]bool, len(graph)),
+	}
+	for i := range graph {
+		v.nodes = append(v.nodes, i)
+		v.included[i] = true
+	}
+	return v, nil
+}
+
+// around restricts the view to the nodes at most radius edges away from the node with
+// the label, following edges in both directions.
+func (v *exportView) around(label string, radius int) error {
+	center, ok := v.index[label]
+	if !ok {
+		return fmt.Errorf("export: unknown label %q", label)
+	}
+	parents := make([][]int, len(v.graph))
+	for i, node := range v.graph {
+		for _, childId := range node.Children {
+			parents[childId] = append(parents[childId], i)
+		}
+	}
+
+	distance := make([]int, len(v.graph))
+	for i := range distance {
+		distance[i] = -1
+	}
+	distance[center] = 0
+	v.nodes = []int{center}
+	for i := 0; i < len(v.nodes); i++ {
+		n := v.nodes[i]
+		if distance[n] == radius {
+			continue
+		}
+		neighbours := append(append([]int(nil), v.graph[n].Children...), parents[n]...)
+		for _, m := range neighbours {
+			if distance[m] < 0 {
+				distance[m] = distance[n] + 1
+				v.nodes = append(v.nodes, m)
+			}
+		}
+	}
+	for i := range v.included {
+		v.included[i] = distance[i] >= 0
+	}
+	return nil
+}
+
+// overlay sets the steps at which the nodes were activated.
+func (v *exportView) overlay(steps []int) {
+	v.steps = steps
+	v.maxStep = 0
+	for _, step := range steps {
+		if step > v.maxStep {
+			v.maxStep = step
+		}
+	}
+}
+
+func (v *exportView) active(i int) bool {
+	return v.steps != nil && v.steps[i] != unreached
+}
+
+// color returns the color of a node as RGB. Active nodes go from red at step 0 to
+// blue at the last step, inactive nodes are light grey.
+func (v *exportView) color(i int) (r, g, b uint8) {
+	if !v.active(i) {
+		return 0xee, 0xee, 0xee
+	}
+	hue := 0.0
+	if v.maxStep > 0 {
+		hue = 240 * float64(v.steps[i]) / float64(v.maxStep)
+	}
+	return hsvToRGB(hue, 0.6, 1)
+}
+
+func hsvToRGB(h, s, v float64) (uint8, uint8, uint8) {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := v - c
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g, b = c, x, 0
+	case h < 120:
+		r, g, b = x, c, 0
+	case h < 180:
+		r, g, b = 0, c, x
+	case h < 240:
+		r, g, b = 0, x, c
+	case h < 300:
+		r, g, b = x, 0, c
+	default:
+		r, g, b = c, 0, x
+	}
+	return uint8(math.Round((r + m) * 255)), uint8(math.Round((g + m) * 255)), uint8(math.Round((b + m) * 255))
+}
+
+// exportEdge is an edge of the view: a child edge or a dashed edge from a label of
+// a rule to the node gated by the rule.
+type exportEdge struct {
+	from, to int
+	rule     bool
+}
+
+func (v *exportView) edges() []exportEdge {
+	var edges []exportEdge
+	for _, i := range v.nodes {
+		for _, childId := range v.graph[i].Children {
+			if v.included[childId] {
+				edges = append(edges, exportEdge{from: i, to: childId})
+			}
+		}
+	}
+	for _, i := range v.nodes {
+		for _, label := range v.graph[i].Rule {
+			if r, ok := v.index[label]; ok && v.included[r] {
+				edges = append(edges, exportEdge{from: r, to: i, rule: true})
+			}
+		}
+	}
+	return edges
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func writeDOT(w io.Writer, v *exportView) error {
+	var buf bytes.Buffer
+	buf.WriteString("digraph knowledge {\n")
+	fmt.Fprintf(&buf, "  comment=%s;\n", dotQuote("graph "+v.hash))
+	buf.WriteString("  node [shape=ellipse, style=filled, fillcolor=\"#ffffff\"];\n")
+	for _, i := range v.nodes {
+		node := v.graph[i]
+		var attrs []string
+		if node.Rule != nil {
+			attrs = append(attrs, "shape=box", "peripheries=2")
+		}
+		if v.steps != nil {
+			r, g, b := v.color(i)
+			attrs = append(attrs, fmt.Sprintf("fillcolor=\"#%02x%02x%02x\"", r, g, b))
+			if v.active(i) {
+				attrs = append(attrs, fmt.Sprintf("xlabel=%d", v.steps[i]))
+			}
+		}
+		if len(attrs) == 0 {
+			fmt.Fprintf(&buf, "  %s;\n", dotQuote(node.Label))
+		} else {
+			fmt.Fprintf(&buf, "  %s [%s];\n", dotQuote(node.Label), strings.Join(attrs, ", "))
+		}
+	}
+	for _, e := range v.edges() {
+		if e.rule {
+			fmt.Fprintf(&buf, "  %s -> %s [style=dashed, color=\"#888888\", arrowhead=odot];\n", dotQuote(v.graph[e.from].Label), dotQuote(v.graph[e.to].Label))
+		} else {
+			fmt.Fprintf(&buf, "  %s -> %s;\n", dotQuote(v.graph[e.from].Label), dotQuote(v.graph[e.to].Label))
+		}
+	}
+	buf.WriteString("}\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+func writeGraphML(w io.Writer, v *exportView) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n")
+	buf.WriteString(`  <key id="label" for="node" attr.name="label" attr.type="string"/>` + "\n")
+	buf.WriteString(`  <key id="rule" for="node" attr.name="rule" attr.type="string"/>` + "\n")
+	buf.WriteString(`  <key id="active" for="node" attr.name="active" attr.type="boolean"/>` + "\n")
+	buf.WriteString(`  <key id="step" for="node" attr.name="step" attr.type="int"/>` + "\n")
+	buf.WriteString(`  <key id="color" for="node" attr.name="color" attr.type="string"/>` + "\n")
+	buf.WriteString(`  <key id="kind" for="edge" attr.name="kind" attr.type="string"><default>child</default></key>` + "\n")
+	buf.WriteString(`  <graph id="knowledge" edgedefault="directed">` + "\n")
+	fmt.Fprintf(&buf, "    <desc>graph %s</desc>\n", v.hash)
+	for _, i := range v.nodes {
+		node := v.graph[i]
+		fmt.Fprintf(&buf, `    <node id="n%d">`+"\n", i)
+		fmt.Fprintf(&buf, `      <data key="label">%s</data>`+"\n", xmlEscape(node.Label))
+		if node.Rule != nil {
+			fmt.Fprintf(&buf, `      <data key="rule">%s</data>`+"\n", xmlEscape(strings.Join(node.Rule, " & ")))
+		}
+		if v.steps != nil {
+			fmt.Fprintf(&buf, `      <data key="active">%t</data>`+"\n", v.active(i))
+			if v.active(i) {
+				fmt.Fprintf(&buf, `      <data key="step">%d</data>`+"\n", v.steps[i])
+			}
+			r, g, b := v.color(i)
+			fmt.Fprintf(&buf, `      <data key="color">#%02x%02x%02x</data>`+"\n", r, g, b)
+		}
+		buf.WriteString("    </node>\n")
+	}
+	for n, e := range v.edges() {
+		if e.rule {
+			fmt.Fprintf(&buf, `    <edge id="e%d" source="n%d" target="n%d"><data key="kind">rule</data></edge>`+"\n", n, e.from, e.to)
+		} else {
+			fmt.Fprintf(&buf, `    <edge id="e%d" source="n%d" target="n%d"/>`+"\n", n, e.from, e.to)
+		}
+	}
+	buf.WriteString("  </graph>\n</graphml>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func writeGEXF(w io.Writer, v *exportView) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<gexf xmlns="http://www.gexf.net/1.2draft" xmlns:viz="http://www.gexf.net/1.2draft/viz" version="1.2">` + "\n")
+	fmt.Fprintf(&buf, "  <meta>\n    <description>graph %s</description>\n  </meta>\n", v.hash)
+	buf.WriteString(`  <graph mode="static" defaultedgetype="directed">` + "\n")
+	buf.WriteString(`    <attributes class="node">` + "\n")
+	buf.WriteString(`      <attribute id="rule" title="rule" type="string"/>` + "\n")
+	buf.WriteString(`      <attribute id="step" title="step" type="integer"/>` + "\n")
+	buf.WriteString("    </attributes>\n")
+	buf.WriteString("    <nodes>\n")
+	for _, i := range v.nodes {
+		node := v.graph[i]
+		fmt.Fprintf(&buf, `      <node id="n%d" label="%s">`+"\n", i, xmlEscape(node.Label))
+		if node.Rule != nil || v.active(i) {
+			buf.WriteString("        <attvalues>\n")
+			if node.Rule != nil {
+				fmt.Fprintf(&buf, `          <attvalue for="rule" value="%s"/>`+"\n", xmlEscape(strings.Join(node.Rule, " & ")))
+			}
+			if v.active(i) {
+				fmt.Fprintf(&buf, `          <attvalue for="step" value="%d"/>`+"\n", v.steps[i])
+			}
+			buf.WriteString("        </attvalues>\n")
+		}
+		if v.steps != nil {
+			r, g, b := v.color(i)
+			fmt.Fprintf(&buf, `        <viz:color r="%d" g="%d" b="%d"/>`+"\n", r, g, b)
+		}
+		if node.Rule != nil {
+			buf.WriteString(`        <viz:shape value="square"/>` + "\n")
+		}
+		buf.WriteString("      </node>\n")
+	}
+	buf.WriteString("    </nodes>\n")
+	buf.WriteString("    <edges>\n")
+	for n, e := range v.edges() {
+		if e.rule {
+			fmt.Fprintf(&buf, `      <edge id="e%d" source="n%d" target="n%d" label="rule"><viz:shape value="dashed"/></edge>`+"\n", n, e.from, e.to)
+		} else {
+			fmt.Fprintf(&buf, `      <edge id="e%d" source="n%d" target="n%d"/>`+"\n", n, e.from, e.to)
+		}
+	}
+	buf.WriteString("    </edges>\n")
+	buf.WriteString("  </graph>\n</gexf>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+var exporters = map[string]func(io.Writer, *exportView) error{
+	"dot":     writeDOT,
+	"graphml": writeGraphML,
+	"gexf":    writeGEXF,
+}
+
+// resultSteps returns the steps at which the nodes of the graph were activated in the
+// result file, which must have been produced from the graph.
+func resultSteps(graph []*LabelNode, file string) []int {
+	r, err := readResult(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if GraphHash(graph) != r.Fingerprint {
+		log.Fatalf("export: %s was not produced from the graph", file)
+	}
+	run, err := r.Run(graph)
+	if err != nil {
+		log.Fatalf("%s: %v", file, err)
+	}
+	steps := make([]int, len(graph))
+	for i, node := range graph {
+		steps[i] = activationStep(run, node.Label)
+	}
+	return steps
+}
+
+func ExportGraph(c *cli.Context) {
+	graph := load(c.String("input"))
+	v, err := newExportView(graph)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	format := c.String("format")
+	if !c.IsSet("format") {
+		format = strings.TrimPrefix(filepath.Ext(c.String("output")), ".")
+	}
+	export, ok := exporters[format]
+	if !ok {
+		log.Fatalf("export: unknown format %q, use dot, graphml or gexf", format)
+	}
+
+	if c.IsSet("result") || c.IsSet("depth") {
+		var steps []int
+		if c.IsSet("result") {
+			steps = resultSteps(graph, c.String("result"))
+		} else {
+			seeds := c.StringSlice("seed")
+			if len(seeds) == 0 && len(graph) > 0 {
+				seeds = []string{graph[0].Label}
+			}
+			steps = Closure(graph, seeds)
+		}
+		if c.IsSet("depth") {
+			for i := range steps {
+				if steps[i] > c.Int("depth") {
+					steps[i] = unreached
+				}
+			}
+		}
+		v.overlay(steps)
+	}
+	if c.IsSet("around") {
+		if err := v.around(c.String("around"), c.Int("radius")); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := export(&buf, v); err != nil {
+		log.Fatal(err)
+	}
+	outputFile := writeOutput(c, buf.Bytes(), map[string]string{"size": strconv.Itoa(len(v.nodes))})
+	fmt.Printf("Nodes exported: %d\nGraph written to %s\n", len(v.nodes), outputFile)
+}
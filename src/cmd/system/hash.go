@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+// canonicalGraph serializes the graph in a form that only depends on its content, not
+// on how the file it was read from was written: whitespace, the order of the fields
+// or children given by label instead of position. Each node is written on a line as
+// its position, quoted label, the positions of its children and the quoted labels of
+// its rule, in order:
+//
+//	0 "fever" children 1 2
+//	1 "flu" children rule "cough" "fever"
+func canonicalGraph(graph []*LabelNode) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "knowledge graph %d\n", len(graph))
+	for i, node := range graph {
+		fmt.Fprintf(&buf, "%d %s children", i, strconv.Quote(node.Label))
+		for _, childId := range node.Children {
+			fmt.Fprintf(&buf, " %d", childId)
+		}
+		if len(node.Rule) > 0 {
+			buf.WriteString(" rule")
+			for _, label := range node.Rule {
+				fmt.Fprintf(&buf, " %s", strconv.Quote(label))
+			}
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// GraphHash returns the SHA-256 of the canonical serialization of the graph, written
+// as sha256:<hex> so it can be found in the files it is embedded in.
+func GraphHash(graph []*LabelNode) string {
+	sum := sha256.Sum256(canonicalGraph(graph))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+var embeddedHash = regexp.MustCompile(`sha256:[0-9a-f]{64}`)
+
+// fileHash returns the hash of the graph a file was produced from: the fingerprint of
+// a result file, or the first hash embedded in any other output.
+func fileHash(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	var r Result
+	if err := json.Unmarshal(data, &r); err == nil && r.Fingerprint != "" {
+		return r.Fingerprint, nil
+	}
+	hash := embeddedHash.Find(data)
+	if hash == nil {
+		return "", fmt.Errorf("%s: no graph hash found", file)
+	}
+	return string(hash), nil
+}
+
+func VerifyFiles(c *cli.Context) {
+	graph := load(c.String("graph"))
+	hash := GraphHash(graph)
+	fmt.Printf("Graph Hash: %s\n", hash)
+
+	ok := true
+	if c.IsSet("hash") && c.String("hash") != hash {
+		fmt.Printf("expected %s\n", c.String("hash"))
+		ok = false
+	}
+	for _, file := range c.Args() {
+		fileHash, err := fileHash(file)
+		switch {
+		case err != nil:
+			fmt.Println(err)
+			ok = false
+		case fileHash != hash:
+			fmt.Printf("%s: produced from %s\n", file, fileHash)
+			ok = false
+		default:
+			fmt.Printf("%s: OK\n", file)
+		}
+	}
+	if !ok {
+		log.Print("verify: the graph does not match")
+		os.Exit(1)
+	}
+}
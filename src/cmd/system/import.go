@@ -0,0 +1,515 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// importStats counts what an importer did with its input.
+type importStats struct {
+	edges   int
+	rules   int
+	skipped int
+}
+
+// importCSV reads an edge list, one edge per record. The columns are source, target
+// and rule, in this order or, if header is set, as named by the first record. The rule
+// is a list of labels separated by & gating the target, or the source if the target
+// is empty. Records starting with # are comments.
+func importCSV(r io.Reader, comma rune, header bool, b *graphBuilder) (importStats, error) {
+	var stats importStats
+	reader := csv.NewReader(r)
+	reader.Comma = comma
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	source, target, rule := 0, 1, 2
+	for n := 1; ; n++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return stats, nil
+		}
+		if err != nil {
+			return stats, err
+		}
+		if header && n == 1 {
+			source, target, rule = -1, -1, -1
+			for i, name := range record {
+				switch strings.ToLower(strings.TrimSpace(name)) {
+				case "source", "from":
+					source = i
+				case "target", "to":
+					target = i
+				case "rule", "requires":
+					rule = i
+				}
+			}
+			if source < 0 {
+				return stats, fmt.Errorf("record 1: no source column in header")
+			}
+			continue
+		}
+
+		field := func(i int) string {
+			if i < 0 || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		if field(source) == "" {
+			return stats, fmt.Errorf("record %d: empty source", n)
+		}
+		gated := b.node(field(source))
+		if field(target) != "" {
+			gated = b.node(field(target))
+			b.edge(b.node(field(source)), gated)
+			stats.edges++
+		}
+		if field(rule) != "" {
+			for _, label := range strings.Split(field(rule), "&") {
+				if label = strings.TrimSpace(label); label == "" {
+					return stats, fmt.Errorf("record %d: empty label in rule %q", n, field(rule))
+				}
+				b.node(label)
+				b.require(gated, label)
+				stats.rules++
+			}
+		}
+	}
+}
+
+type graphmlData struct {
+	Key   string `xml:"key,attr"`
+	Value string `xml:",chardata"`
+}
+
+type graphmlDocument struct {
+	Keys []struct {
+		Id   string `xml:"id,attr"`
+		For  string `xml:"for,attr"`
+		Name string `xml:"attr.name,attr"`
+	} `xml:"key"`
+	Graph struct {
+		Nodes []struct {
+			Id   string        `xml:"id,attr"`
+			Data []graphmlData `xml:"data"`
+		} `xml:"node"`
+		Edges []struct {
+			Source string        `xml:"source,attr"`
+			Target string        `xml:"target,attr"`
+			Data   []graphmlData `xml:"data"`
+		} `xml:"edge"`
+	} `xml:"graph"`
+}
+
+// importGraphML reads the first graph of a GraphML document. Nodes are labelled by
+// their label data if declared, by their id otherwise. A rule data on a node, labels
+// separated by &, or edges whose kind data is rule, as written by export, gate the
+// target node. Labels of a rule that are not declared nodes are added as nodes.
+func importGraphML(r io.Reader, b *graphBuilder) (importStats, error) {
+	var stats importStats
+	var doc graphmlDocument
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return stats, err
+	}
+	keys := make(map[string]string)
+	for _, key := range doc.Keys {
+		keys[key.For+"\x00"+key.Id] = key.Name
+	}
+	data := graphmlLookup(keys)
+
+	labels := make(map[string]string)
+	ruled := make(map[string]bool)
+	var required []string
+	for _, node := range doc.Graph.Nodes {
+		label := node.Id
+		if l, ok := data("node", node.Data, "label"); ok && l != "" {
+			label = l
+		}
+		labels[node.Id] = label
+		i := b.node(label)
+		if rule, ok := data("node", node.Data, "rule"); ok && strings.TrimSpace(rule) != "" {
+			ruled[node.Id] = true
+			for _, r := range strings.Split(rule, "&") {
+				if r = strings.TrimSpace(r); r == "" {
+					return stats, fmt.Errorf("node %q: empty label in rule %q", node.Id, rule)
+				}
+				b.require(i, r)
+				required = append(required, r)
+				stats.rules++
+			}
+		}
+	}
+	// The labels of the rules are added as nodes once all the declared nodes are, so
+	// the declared nodes keep the order of the document.
+	for _, label := range required {
+		b.node(label)
+	}
+	for n, edge := range doc.Graph.Edges {
+		source, ok := labels[edge.Source]
+		if !ok {
+			return stats, fmt.Errorf("edge %d: unknown source node %q", n, edge.Source)
+		}
+		target, ok := labels[edge.Target]
+		if !ok {
+			return stats, fmt.Errorf("edge %d: unknown target node %q", n, edge.Target)
+		}
+		if kind, _ := data("edge", edge.Data, "kind"); kind == "rule" {
+			// The rule data of the node already lists the labels of its rule edges.
+			if !ruled[edge.Target] {
+				b.require(b.node(target), source)
+				stats.rules++
+			}
+			continue
+		}
+		b.edge(b.node(source), b.node(target))
+		stats.edges++
+	}
+	return stats, nil
+}
+
+// graphmlLookup returns a lookup of GraphML data by attribute name.
+func graphmlLookup(keys map[string]string) func(kind string, data []graphmlData, name string) (string, bool) {
+	return func(kind string, data []graphmlData, name string) (string, bool) {
+		for _, d := range data {
+			if keys[kind+"\x00"+d.Key] == name || keys["all\x00"+d.Key] == name {
+				return strings.TrimSpace(d.Value), true
+			}
+		}
+		return "", false
+	}
+}
+
+const rdfType = "http://www.w3.org/1999/02/22-rdf-syntax-ns#type"
+
+// rdfTerm is a subject, predicate or object of a triple. IRIs and blank nodes are
+// labels, literals are skipped by the importer.
+type rdfTerm struct {
+	value   string
+	literal bool
+}
+
+// predicateMatches checks if the predicate is one of the names, given as full IRIs or
+// as local names, the part after the last # or /.
+func predicateMatches(predicate string, names []string) bool {
+	local := predicate[strings.LastIndexAny(predicate, "#/")+1:]
+	for _, name := range names {
+		if name == predicate || name == local {
+			return true
+		}
+	}
+	return false
+}
+
+// turtleParser parses N-Triples and the subset of Turtle made of prefix directives,
+// prefixed names, the a keyword, and predicate and object lists. Collections and
+// blank node property lists are not supported.
+type turtleParser struct {
+	file     string
+	src      []rune
+	pos      int
+	line     int
+	col      int
+	prefixes map[string]string
+}
+
+func (p *turtleParser) errorf(line, col int, format string, args ...interface{}) error {
+	return &SyntaxError{File: p.file, Line: line, Col: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *turtleParser) peek() rune {
+	if p.pos >= len(p.src) {
+		return -1
+	}
+	return p.src[p.pos]
+}
+
+func (p *turtleParser) advance() {
+	if p.src[p.pos] == '\n' {
+		p.line++
+		p.col = 1
+	} else {
+		p.col++
+	}
+	p.pos++
+}
+
+func (p *turtleParser) skipSpace() {
+	for {
+		r := p.peek()
+		if r == '#' {
+			for r != '\n' && r != -1 {
+				p.advance()
+				r = p.peek()
+			}
+		}
+		if r == -1 || !unicode.IsSpace(r) {
+			return
+		}
+		p.advance()
+	}
+}
+
+// punct consumes the punctuation r if it is next.
+func (p *turtleParser) punct(r rune) bool {
+	p.skipSpace()
+	if p.peek() == r {
+		p.advance()
+		return true
+	}
+	return false
+}
+
+func (p *turtleParser) expect(r rune) error {
+	line, col := p.line, p.col
+	if !p.punct(r) {
+		return p.errorf(line, col, "expected %q", r)
+	}
+	return nil
+}
+
+// word reads a run of characters up to a delimiter.
+func (p *turtleParser) word() string {
+	start := p.pos
+	for r := p.peek(); r != -1 && !unicode.IsSpace(r) && !strings.ContainsRune("<>\"{}[](),;#", r); r = p.peek() {
+		// A dot ends a word unless it is followed by more of the word.
+		if r == '.' && (p.pos+1 >= len(p.src) || unicode.IsSpace(p.src[p.pos+1]) || p.src[p.pos+1] == '#') {
+			break
+		}
+		p.advance()
+	}
+	return string(p.src[start:p.pos])
+}
+
+func (p *turtleParser) term() (rdfTerm, error) {
+	p.skipSpace()
+	line, col := p.line, p.col
+	switch r := p.peek(); {
+	case r == -1:
+		return rdfTerm{}, p.errorf(line, col, "unexpected end of file")
+	case r == '<':
+		p.advance()
+		start := p.pos
+		for p.peek() != '>' {
+			if p.peek() == -1 || p.peek() == '\n' {
+				return rdfTerm{}, p.errorf(line, col, "unterminated IRI")
+			}
+			p.advance()
+		}
+		iri := string(p.src[start:p.pos])
+		p.advance()
+		return rdfTerm{value: iri}, nil
+	case r == '"':
+		if p.pos+2 < len(p.src) && p.src[p.pos+1] == '"' && p.src[p.pos+2] == '"' {
+			return rdfTerm{}, p.errorf(line, col, "long strings are not supported")
+		}
+		start := p.pos
+		p.advance()
+		for p.peek() != '"' {
+			if p.peek() == -1 || p.peek() == '\n' {
+				return rdfTerm{}, p.errorf(line, col, "unterminated string")
+			}
+			if p.peek() == '\\' {
+				p.advance()
+			}
+			p.advance()
+		}
+		p.advance()
+		value, err := strconv.Unquote(string(p.src[start:p.pos]))
+		if err != nil {
+			value = string(p.src[start+1 : p.pos-1])
+		}
+		// Language tags and datatypes do not matter, literals are skipped.
+		if p.peek() == '@' {
+			p.word()
+		} else if p.peek() == '^' {
+			p.advance()
+			if !p.punct('^') {
+				return rdfTerm{}, p.errorf(p.line, p.col, "expected ^^ before datatype")
+			}
+			if _, err := p.term(); err != nil {
+				return rdfTerm{}, err
+			}
+		}
+		return rdfTerm{value: value, literal: true}, nil
+	case r == '[' || r == '(':
+		return rdfTerm{}, p.errorf(line, col, "%c is not supported, use named blank nodes", r)
+	default:
+		word := p.word()
+		switch {
+		case word == "":
+			return rdfTerm{}, p.errorf(line, col, "unexpected character %q", r)
+		case word == "a":
+			return rdfTerm{value: rdfType}, nil
+		case word == "true" || word == "false" || strings.IndexFunc(word, unicode.IsLetter) < 0:
+			return rdfTerm{value: word, literal: true}, nil
+		case strings.HasPrefix(word, "_:"):
+			return rdfTerm{value: word}, nil
+		}
+		colon := strings.Index(word, ":")
+		if colon < 0 {
+			return rdfTerm{}, p.errorf(line, col, "unexpected %q", word)
+		}
+		ns, ok := p.prefixes[word[:colon]]
+		if !ok {
+			return rdfTerm{}, p.errorf(line, col, "undefined prefix %q", word[:colon+1])
+		}
+		return rdfTerm{value: ns + word[colon+1:]}, nil
+	}
+}
+
+// parse calls triple for each triple of the document.
+func (p *turtleParser) parse(triple func(s, pr, o rdfTerm) error) error {
+	for {
+		p.skipSpace()
+		if p.peek() == -1 {
+			return nil
+		}
+		line, col := p.line, p.col
+		if p.peek() == '@' || p.peek() == 'P' || p.peek() == 'p' || p.peek() == 'B' || p.peek() == 'b' {
+			save, saveLine, saveCol := p.pos, p.line, p.col
+			word := p.word()
+			switch strings.ToLower(word) {
+			case "@prefix", "prefix":
+				p.skipSpace()
+				name := p.word()
+				if !strings.HasSuffix(name, ":") {
+					return p.errorf(line, col, "expected prefix name, found %q", name)
+				}
+				iri, err := p.term()
+				if err != nil {
+					return err
+				}
+				p.prefixes[strings.TrimSuffix(name, ":")] = iri.value
+				if word == "@prefix" {
+					if err := p.expect('.'); err != nil {
+						return err
+					}
+				}
+				continue
+			case "@base", "base":
+				return p.errorf(line, col, "base directives are not supported")
+			}
+			p.pos, p.line, p.col = save, saveLine, saveCol
+		}
+
+		subject, err := p.term()
+		if err != nil {
+			return err
+		}
+		if subject.literal {
+			return p.errorf(line, col, "a literal cannot be a subject")
+		}
+		for {
+			predicate, err := p.term()
+			if err != nil {
+				return err
+			}
+			for {
+				object, err := p.term()
+				if err != nil {
+					return err
+				}
+				if err := triple(subject, predicate, object); err != nil {
+					return p.errorf(line, col, "%v", err)
+				}
+				if !p.punct(',') {
+					break
+				}
+			}
+			if !p.punct(';') {
+				break
+			}
+			// A predicate list can end with a ;
+			if p.skipSpace(); p.peek() == '.' {
+				break
+			}
+		}
+		if err := p.expect('.'); err != nil {
+			return err
+		}
+	}
+}
+
+// importTriples reads N-Triples or Turtle. Subjects and objects are labels. Triples
+// whose predicate is one of the rule predicates make the object part of the rule of
+// the subject. The other triples are edges from the subject to the object, for the
+// edge predicates only if any are given. Triples with literal objects are skipped.
+func importTriples(file string, r io.Reader, edgePredicates, rulePredicates []string, b *graphBuilder) (importStats, error) {
+	var stats importStats
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return stats, err
+	}
+	p := &turtleParser{file: file, src: []rune(string(data)), line: 1, col: 1, prefixes: make(map[string]string)}
+	err = p.parse(func(s, pr, o rdfTerm) error {
+		switch {
+		case o.literal:
+			stats.skipped++
+		case predicateMatches(pr.value, rulePredicates):
+			b.require(b.node(s.value), o.value)
+			b.node(o.value)
+			stats.rules++
+		case len(edgePredicates) == 0 || predicateMatches(pr.value, edgePredicates):
+			b.edge(b.node(s.value), b.node(o.value))
+			stats.edges++
+		default:
+			stats.skipped++
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func ImportGraph(c *cli.Context) {
+	inputFile := c.String("input")
+	format := c.String("format")
+	if !c.IsSet("format") {
+		format = strings.TrimPrefix(filepath.Ext(inputFile), ".")
+	}
+
+	f, err := os.Open(inputFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	b := newGraphBuilder()
+	var stats importStats
+	switch format {
+	case "csv":
+		stats, err = importCSV(f, ',', c.Bool("header"), b)
+	case "tsv":
+		stats, err = importCSV(f, '\t', c.Bool("header"), b)
+	case "graphml":
+		stats, err = importGraphML(f, b)
+	case "nt", "ttl":
+		stats, err = importTriples(inputFile, f, c.StringSlice("edge-predicate"), c.StringSlice("rule-predicate"), b)
+	default:
+		log.Fatalf("import: unknown format %q, use csv, tsv, graphml, nt or ttl", format)
+	}
+	if err != nil {
+		if _, ok := err.(*SyntaxError); ok {
+			log.Fatal(err)
+		}
+		log.Fatalf("%s: %v", inputFile, err)
+	}
+
+	graph, err := b.build(c.String("seed"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Graph Size: %d\nEdges: %d\nRule labels: %d\nSkipped: %d\n", len(graph), stats.edges, stats.rules, stats.skipped)
+	outputGraph(c, graph, map[string]string{"size": strconv.Itoa(len(graph))})
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// unreached is the step of a node that can never be activated from the seeds.
+const unreached = -1
+
+// Activity is the set of nodes activated from a set of seeds, kept up to date as the
+// graph is mutated instead of being recomputed from scratch.
+//
+// Unlike the simulations, which depend on the order in which goroutines or map
+// iterations happen to visit nodes, an Activity has a deterministic meaning: the
+// seeds are active at step 0 and a node is active at step n+1 if one of its parents
+// is active at step n and every label of its rule is active at step n or before. As
+// in the simulations, the rule of a node is only checked when a parent reaches it: a
+// node reached before the labels of its rule are active is not activated when they
+// become active later, only when another parent reaches it. The step of a node is
+// the first step at which it is active, and the nodes active within a depth are the
+// ones with a step <= depth.
+//
+// The simulations differ for the labels activated at step n+1 by the other nodes
+// reached at the same time: whether they are active when the rule is checked
+// depends on the order the nodes are visited in, an Activity never counts them.
+type Activity struct {
+	Graph []*LabelNode
+
+	seeds map[string]bool
+	steps []int
+
+	ids        map[string]int
+	parents    [][]int
+	dependents map[string][]int
+}
+
+func NewActivity(graph []*LabelNode, seeds []string) *Activity {
+	a := &Activity{
+		Graph: graph,
+		seeds: make(map[string]bool),
+	}
+	for _, seed := range seeds {
+		a.seeds[seed] = true
+	}
+	a.index()
+	a.steps = Closure(graph, seeds)
+	return a
+}
+
+// index builds the reverse edges of the graph needed to find which nodes may be
+// affected by a change.
+func (a *Activity) index() {
+	a.ids = make(map[string]int, len(a.Graph))
+	a.parents = make([][]int, len(a.Graph))
+	a.dependents = make(map[string][]int)
+	for i, node := range a.Graph {
+		a.ids[node.Label] = i
+		for _, childId := range node.Children {
+			a.parents[childId] = append(a.parents[childId], i)
+		}
+		for _, label := range node.Rule {
+			a.dependents[label] = append(a.dependents[label], i)
+		}
+	}
+}
+
+// Step returns the step at which the node is activated or unreached.
+func (a *Activity) Step(label string) int {
+	i, ok := a.ids[label]
+	if !ok {
+		return unreached
+	}
+	return a.steps[i]
+}
+
+// Run returns the nodes active within depth as a Run, with the trace ordered by step.
+func (a *Activity) Run(depth int) *Run {
+	var ids []int
+	for i, step := range a.steps {
+		if step != unreached && step <= depth {
+			ids = append(ids, i)
+		}
+	}
+	sort.Sort(byStep{ids, a.steps})
+
+	run := NewRun(a.Graph)
+	for _, i := range ids {
+		run.Activate(a.Graph[i], a.steps[i])
+	}
+	return run
+}
+
+// Apply applies the mutation to the graph and updates the steps of the nodes it
+// affects.
+func (a *Activity) Apply(m Mutation) error {
+	graph, err := m.Apply(a.Graph)
+	if err != nil {
+		return err
+	}
+
+	switch m.Op {
+	case AddNode:
+		a.Graph = graph
+		i := len(graph) - 1
+		a.ids[m.Label] = i
+		a.parents = append(a.parents, nil)
+		a.steps = append(a.steps, unreached)
+		for _, label := range m.Rule {
+			a.dependents[label] = append(a.dependents[label], i)
+		}
+		// A new node has no parents, it can only be active if it is a seed. The
+		// rules referencing its label are rechecked once it is.
+		a.update([]int{i})
+
+	case AddEdge:
+		a.Graph = graph
+		from, to := a.ids[m.Label], a.ids[m.Target]
+		a.parents[to] = append(a.parents[to], from)
+		a.update([]int{to})
+
+	case SetRule:
+		i := a.ids[m.Label]
+		for _, label := range a.Graph[i].Rule {
+			a.dependents[label] = removeId(a.dependents[label], i)
+		}
+		a.Graph = graph
+		for _, label := range m.Rule {
+			a.dependents[label] = append(a.dependents[label], i)
+		}
+		a.update([]int{i})
+
+	case RemoveNode:
+		removed := a.ids[m.Label]
+		affected := append([]int(nil), a.Graph[removed].Children...)
+		affected = append(affected, a.dependents[m.Label]...)
+		// Every node that could depend on the removed node is invalidated before
+		// renumbering, then the indices are rebuilt for the new graph.
+		invalid := a.invalidate(affected)
+		a.Graph = graph
+		a.steps = append(a.steps[:removed], a.steps[removed+1:]...)
+		var shifted []int
+		for _, i := range invalid {
+			switch {
+			case i > removed:
+				shifted = append(shifted, i-1)
+			case i < removed:
+				shifted = append(shifted, i)
+			}
+		}
+		a.index()
+		a.recompute(shifted)
+	}
+	return nil
+}
+
+// update invalidates the nodes whose step may change, and everything depending on
+// them, then recomputes their steps.
+func (a *Activity) update(nodes []int) {
+	a.recompute(a.invalidate(nodes))
+}
+
+// invalidate resets the steps of the given nodes and of every node depending on them,
+// directly or not. As a parent activated earlier can reach a node before the labels
+// of its rule are active, a step decreasing can delay the nodes depending on it as
+// well as advance them, so they are all reset whatever their steps. It returns the
+// reset nodes, which need to be recomputed.
+func (a *Activity) invalidate(nodes []int) []int {
+	var invalid []int
+	seen := make(map[int]bool)
+	queue := append([]int(nil), nodes...)
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if seen[i] {
+			continue
+		}
+		seen[i] = true
+		invalid = append(invalid, i)
+		a.steps[i] = unreached
+		for _, dependent := range a.dependsOn(i) {
+			if !seen[dependent] {
+				queue = append(queue, dependent)
+			}
+		}
+	}
+	return invalid
+}
+
+// dependsOn returns the nodes whose step is computed from the step of node i.
+func (a *Activity) dependsOn(i int) []int {
+	nodes := append([]int(nil), a.Graph[i].Children...)
+	return append(nodes, a.dependents[a.Graph[i].Label]...)
+}
+
+// candidate computes the step of node i from the current steps of its parents and
+// of the labels of its rule: the step after the earliest parent reaching it once
+// every label of its rule is active.
+func (a *Activity) candidate(i int) int {
+	node := a.Graph[i]
+	if a.seeds[node.Label] {
+		return 0
+	}
+	rule := ruleStep(node, a.ids, a.steps)
+	if rule == unreached {
+		return unreached
+	}
+	step := unreached
+	for _, p := range a.parents[i] {
+		if a.steps[p] != unreached && a.steps[p] >= rule && (step == unreached || a.steps[p]+1 < step) {
+			step = a.steps[p] + 1
+		}
+	}
+	return step
+}
+
+// ruleStep returns the step from which every label of the rule of the node is active,
+// 0 for a node without rule, or unreached if a label never is.
+func ruleStep(node *LabelNode, ids map[string]int, steps []int) int {
+	rule := 0
+	for _, label := range node.Rule {
+		r, ok := ids[label]
+		if !ok || steps[r] == unreached {
+			return unreached
+		}
+		if steps[r] > rule {
+			rule = steps[r]
+		}
+	}
+	return rule
+}
+
+// recompute sets the steps of the given nodes, which must be invalidated along with
+// every node depending on them, to their candidate steps and propagates them in step
+// order, similarly to Dijkstra's algorithm. The step of a node is always greater than
+// the steps it is computed from, and a candidate step only decreases as more of them
+// are set, so a node is final once it is popped from the heap.
+func (a *Activity) recompute(nodes []int) {
+	h := &stepHeap{}
+	for _, i := range nodes {
+		if step := a.candidate(i); step != unreached && (a.steps[i] == unreached || step < a.steps[i]) {
+			heap.Push(h, stepEntry{i, step})
+		}
+	}
+	for h.Len() > 0 {
+		e := heap.Pop(h).(stepEntry)
+		if a.steps[e.id] != unreached && a.steps[e.id] <= e.step {
+			continue
+		}
+		a.steps[e.id] = e.step
+		for _, dependent := range a.dependsOn(e.id) {
+			step := a.candidate(dependent)
+			if step != unreached && (a.steps[dependent] == unreached || step < a.steps[dependent]) {
+				heap.Push(h, stepEntry{dependent, step})
+			}
+		}
+	}
+}
+
+// Closure computes the step of every node of the graph from scratch, level by level.
+// It is the reference the incremental updates of an Activity are checked against.
+// The nodes of a level reach their children once all of them are active, and the
+// rule of a child is checked with the nodes active then, those of the level and
+// before.
+func Closure(graph []*LabelNode, seeds []string) []int {
+	steps := make([]int, len(graph))
+	for i := range steps {
+		steps[i] = unreached
+	}
+	ids := make(map[string]int, len(graph))
+	for i, node := range graph {
+		ids[node.Label] = i
+	}
+
+	var level []int
+	for _, seed := range seeds {
+		if i, ok := ids[seed]; ok && steps[i] == unreached {
+			steps[i] = 0
+			level = append(level, i)
+		}
+	}
+	for step := 0; len(level) > 0; step++ {
+		var next []int
+		for _, i := range level {
+			for _, c := range graph[i].Children {
+				// The labels activated at step+1 by the level are not counted.
+				if rule := ruleStep(graph[c], ids, steps); steps[c] == unreached && rule != unreached && rule <= step {
+					steps[c] = step + 1
+					next = append(next, c)
+				}
+			}
+		}
+		level = next
+	}
+	return steps
+}
+
+func removeId(ids []int, id int) []int {
+	for i := range ids {
+		if ids[i] == id {
+			return append(ids[:i:i], ids[i+1:]...)
+		}
+	}
+	return ids
+}
+
+type stepEntry struct {
+	id   int
+	step int
+}
+
+type stepHeap []stepEntry
+
+func (h stepHeap) Len() int            { return len(h) }
+func (h stepHeap) Less(i, j int) bool  { return h[i].step < h[j].step }
+func (h stepHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *stepHeap) Push(x interface{}) { *h = append(*h, x.(stepEntry)) }
+func (h *stepHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+type byStep struct {
+	ids   []int
+	steps []int
+}
+
+func (a byStep) Len() int      { return len(a.ids) }
+func (a byStep) Swap(i, j int) { a.ids[i], a.ids[j] = a.ids[j], a.ids[i] }
+func (a byStep) Less(i, j int) bool {
+	if a.steps[a.ids[i]] != a.steps[a.ids[j]] {
+		return a.steps[a.ids[i]] < a.steps[a.ids[j]]
+	}
+	return a.ids[i] < a.ids[j]
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func TestIncremental(t *testing.T) {
+	for seed := int64(1); seed <= 5; seed++ {
+		graph := generateRandomTreeWithRules(4, 1000, seed)
+		if _, _, err := checkIncremental(graph, rand.New(rand.NewSource(seed)), 500); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+	}
+}
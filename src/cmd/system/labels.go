@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strconv"
+)
+
+// LabelIndex maps the label of each node of a graph to its position.
+type LabelIndex map[string]int
+
+// NewLabelIndex indexes the nodes of graph by label. Labels must be unique for edges
+// and rules to be addressed by label.
+func NewLabelIndex(graph []*LabelNode) (LabelIndex, error) {
+	index := make(LabelIndex, len(graph))
+	for i, node := range graph {
+		if j, ok := index[node.Label]; ok {
+			return nil, fmt.Errorf("nodes %d and %d have the same label %q", j, i, node.Label)
+		}
+		index[node.Label] = i
+	}
+	return index, nil
+}
+
+// graphBuilder builds a graph from nodes and edges given by label. Nodes are numbered
+// in the order they first appear.
+type graphBuilder struct {
+	graph []*LabelNode
+	index LabelIndex
+	edges map[[2]int]bool
+}
+
+func newGraphBuilder() *graphBuilder {
+	return &graphBuilder{
+		index: make(LabelIndex),
+		edges: make(map[[2]int]bool),
+	}
+}
+
+// node returns the position of the node with the label, adding it if needed.
+func (b *graphBuilder) node(label string) int {
+	if i, ok := b.index[label]; ok {
+		return i
+	}
+	i := len(b.graph)
+	b.index[label] = i
+	b.graph = append(b.graph, &LabelNode{Id: i, Label: label, Children: []int{}})
+	return i
+}
+
+// edge adds an edge from parent to child unless it already exists.
+func (b *graphBuilder) edge(parent, child int) {
+	if b.edges[[2]int{parent, child}] {
+		return
+	}
+	b.edges[[2]int{parent, child}] = true
+	b.graph[parent].Children = append(b.graph[parent].Children, child)
+}
+
+// require adds the label to the rule of node i unless it is already required.
+func (b *graphBuilder) require(i int, label string) {
+	for _, r := range b.graph[i].Rule {
+		if r == label {
+			return
+		}
+	}
+	b.graph[i].Rule = append(b.graph[i].Rule, label)
+}
+
+// build returns the graph with the node labelled seed moved first, since the first
+// node is the seed of the simulations. If seed is empty the order is kept.
+func (b *graphBuilder) build(seed string) ([]*LabelNode, error) {
+	if seed == "" {
+		return b.graph, nil
+	}
+	seedId, ok := b.index[seed]
+	if !ok {
+		return nil, fmt.Errorf("seed %q is not a node", seed)
+	}
+	order := []int{seedId}
+	for i := range b.graph {
+		if i != seedId {
+			order = append(order, i)
+		}
+	}
+	return renumber(b.graph, order), nil
+}
+
+// fileNode is a node as written in a graph file. Each child is either a number, the
+// position of the child in the file, or a string, the label of the child. Id is
+// ignored when reading, nodes are numbered by position.
+type fileNode struct {
+	Id       int
+	Label    string
+	Rule     []string          `json:",omitempty"`
+	Children []json.RawMessage `json:",omitempty"`
+}
+
+// readGraph reads and merges the graph files. Children given by position refer to
+// nodes of the same file while children given by label can refer to nodes of any of
+// the files.
+func readGraph(inputFiles ...string) ([]*LabelNode, error) {
+	var files [][]fileNode
+	for _, inputFile := range inputFiles {
+		data, err := ioutil.ReadFile(inputFile)
+		if err != nil {
+			return nil, err
+		}
+		var nodes []fileNode
+		if err := json.Unmarshal(data, &nodes); err != nil {
+			return nil, fmt.Errorf("%s: %v", inputFile, err)
+		}
+		files = append(files, nodes)
+	}
+	graph, err := resolveGraph(files)
+	if err != nil && len(inputFiles) == 1 {
+		return nil, fmt.Errorf("%s: %v", inputFiles[0], err)
+	}
+	return graph, err
+}
+
+// decodeGraph decodes a single graph file.
+func decodeGraph(data []byte) ([]*LabelNode, error) {
+	var nodes []fileNode
+	if err := json.Unmarshal(data, &nodes); err != nil {
+		return nil, err
+	}
+	return resolveGraph([][]fileNode{nodes})
+}
+
+// resolveGraph builds the label index of the nodes of all the files and resolves
+// their children to positions in the merged graph.
+func resolveGraph(files [][]fileNode) ([]*LabelNode, error) {
+	var graph []*LabelNode
+	for _, nodes := range files {
+		for _, node := range nodes {
+			graph = append(graph, &LabelNode{
+				Id:    len(graph),
+				Label: node.Label,
+				Rule:  node.Rule,
+			})
+		}
+	}
+	index, err := NewLabelIndex(graph)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := 0
+	for _, nodes := range files {
+		for i, node := range nodes {
+			// Children stays nil for null children, as when they were decoded directly,
+			// so that a graph read back is the same as the one written.
+			var children []int
+			if node.Children != nil {
+				children = make([]int, 0, len(node.Children))
+			}
+			for _, child := range node.Children {
+				var position int
+				var label string
+				if err := json.Unmarshal(child, &position); err == nil {
+					if position < 0 || position >= len(nodes) {
+						return nil, fmt.Errorf("node %q: child %d out of range", node.Label, position)
+					}
+					children = append(children, offset+position)
+				} else if err := json.Unmarshal(child, &label); err == nil {
+					childId, ok := index[label]
+					if !ok {
+						return nil, fmt.Errorf("node %q: unknown child %q", node.Label, label)
+					}
+					children = append(children, childId)
+				} else {
+					return nil, fmt.Errorf("node %q: child %s is neither a position nor a label", node.Label, child)
+				}
+			}
+			graph[offset+i].Children = children
+		}
+		offset += len(nodes)
+	}
+	return graph, nil
+}
+
+// marshalGraph encodes the graph in the graph file format, with the children given
+// by position or by label.
+func marshalGraph(graph []*LabelNode, byLabel bool) ([]byte, error) {
+	if !byLabel {
+		return json.MarshalIndent(graph, "", "  ")
+	}
+	nodes := make([]fileNode, len(graph))
+	for i, node := range graph {
+		nodes[i] = fileNode{Id: node.Id, Label: node.Label, Rule: node.Rule}
+		for _, childId := range node.Children {
+			b, err := json.Marshal(graph[childId].Label)
+			if err != nil {
+				return nil, err
+			}
+			nodes[i].Children = append(nodes[i].Children, b)
+		}
+	}
+	return json.MarshalIndent(nodes, "", "  ")
+}
+
+// renumber returns a copy of the graph with its nodes in a new order and ids and
+// children updated accordingly. order lists the current positions of the nodes in
+// their new order.
+func renumber(graph []*LabelNode, order []int) []*LabelNode {
+	positions := make([]int, len(graph))
+	for newId, oldId := range order {
+		positions[oldId] = newId
+	}
+	newGraph := make([]*LabelNode, len(graph))
+	for newId, oldId := range order {
+		node := copyNode(graph[oldId])
+		node.Id = newId
+		for i, childId := range node.Children {
+			node.Children[i] = positions[childId]
+		}
+		newGraph[newId] = node
+	}
+	return newGraph
+}
+
+// labelOrder orders the nodes by label, keeping the first node first since it is the
+// seed of the simulations.
+func labelOrder(graph []*LabelNode) []int {
+	order := make([]int, len(graph))
+	for i := range order {
+		order[i] = i
+	}
+	if len(order) > 1 {
+		sort.Sort(byLabel{order[1:], graph})
+	}
+	return order
+}
+
+type byLabel struct {
+	ids   []int
+	graph []*LabelNode
+}
+
+func (a byLabel) Len() int           { return len(a.ids) }
+func (a byLabel) Swap(i, j int)      { a.ids[i], a.ids[j] = a.ids[j], a.ids[i] }
+func (a byLabel) Less(i, j int) bool { return a.graph[a.ids[i]].Label < a.graph[a.ids[j]].Label }
+
+// bfsOrder orders the nodes breadth first from the first node, the nodes it cannot
+// reach keep their relative order at the end.
+func bfsOrder(graph []*LabelNode) []int {
+	var order []int
+	if len(graph) == 0 {
+		return order
+	}
+	seen := make([]bool, len(graph))
+	queue := new(Queue)
+	seen[0] = true
+	queue.Enqueue(graph[0])
+	for node := queue.Dequeue(); node != nil; node = queue.Dequeue() {
+		order = append(order, node.Id)
+		for _, childId := range node.Children {
+			if !seen[childId] {
+				seen[childId] = true
+				queue.Enqueue(graph[childId])
+			}
+		}
+	}
+	for i := range graph {
+		if !seen[i] {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+func RenumberGraph(c *cli.Context) {
+	inputFiles := c.StringSlice("input")
+	if len(inputFiles) == 0 {
+		log.Fatal("renumber: no input file")
+	}
+	graph, err := readGraph(inputFiles...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch c.String("order") {
+	case "input":
+	case "label":
+		graph = renumber(graph, labelOrder(graph))
+	case "bfs":
+		graph = renumber(graph, bfsOrder(graph))
+	default:
+		log.Fatalf("renumber: unknown order %q", c.String("order"))
+	}
+
+	fmt.Printf("Graph Size: %d\n", len(graph))
+	outputGraph(c, graph, map[string]string{"size": strconv.Itoa(len(graph))})
+}
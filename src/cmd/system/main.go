@@ -1,12 +1,13 @@
 package main
 
 import (
-	"fmt"
 	"github.com/codegangsta/cli"
 	// "github.com/davecgh/go-spew/spew"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -21,37 +22,431 @@ func main() {
 			Name:        "test",
 			Usage:       "Run a test simulation",
 			Description: "Runs a test simulation with specified parameters and prints out the amount of time taken to run, excluding setup.",
-			Flags: []cli.Flag{
+			Flags:       simulationFlags(),
+			Action:      simulationAction("test"),
+		},
+		cli.Command{
+			Name:        "concurrent",
+			Usage:       "Run a concurrent version of the test simulation.",
+			Description: `Runs a concurrent version of the test simulation with specified parameters and prints out the amount of time taken to run, excluding setup.`,
+			Flags: simulationFlags(
 				cli.IntFlag{
-					Name:   "depth, d",
-					Value:  100,
-					Usage:  "The depth for each simulation run",
-					EnvVar: "SIM_DEPTH",
+					Name:  "procs, p",
+					Value: 1,
+					Usage: "The number of processors to be used by the runtime. Can also be set using env var GOMAXPROCS",
+				},
+				cli.IntFlag{
+					Name:  "routines, r, workers, w",
+					Value: 5,
+					Usage: "The number of routines to be used by the simulation. Best to set <= procs",
+				},
+				cli.IntFlag{
+					Name:  "buffer, b",
+					Value: 100,
+					Usage: "The buffer size used by the communication channel between goroutines. If not set it is scaled to graph size: size * 10",
 				},
+				cli.IntFlag{
+					Name:  "batch",
+					Value: 64,
+					Usage: "The number of nodes sent at once over the channels between goroutines.",
+				},
+			),
+			Action: simulationAction("concurrent"),
+		},
+		cli.Command{
+			Name:        "parallel",
+			Usage:       "Run a work stealing version of the test simulation.",
+			Description: `Runs the test simulation with workers that each expand the nodes of their own deque and steal from the others when idle, claiming nodes in a shared visited bitmap instead of sending them to a collector. Prints out the amount of time taken to run, excluding setup.`,
+			Flags: simulationFlags(
+				cli.IntFlag{
+					Name:  "procs, p",
+					Usage: "The number of processors to be used by the runtime. Can also be set using env var GOMAXPROCS",
+				},
+				cli.IntFlag{
+					Name:  "workers, w",
+					Value: runtime.NumCPU(),
+					Usage: "The number of worker goroutines.",
+				},
+			),
+			Action: simulationAction("parallel"),
+		},
+		mutationCommand("add-node", "Add a node to a graph",
+			[]cli.Flag{
+				cli.StringFlag{Name: "label, l", Usage: "Label of the new node."},
+				cli.StringSliceFlag{Name: "rule", Value: &cli.StringSlice{}, Usage: "Label required by the rule of the new node. Can be repeated."},
+			},
+			func(c *cli.Context) Mutation {
+				return Mutation{Op: AddNode, Label: c.String("label"), Rule: c.StringSlice("rule")}
+			}),
+		mutationCommand("add-edge", "Add an edge between two nodes of a graph",
+			[]cli.Flag{
+				cli.StringFlag{Name: "from", Usage: "Label of the parent node."},
+				cli.StringFlag{Name: "to", Usage: "Label of the child node."},
+			},
+			func(c *cli.Context) Mutation {
+				return Mutation{Op: AddEdge, Label: c.String("from"), Target: c.String("to")}
+			}),
+		mutationCommand("remove-node", "Remove a node and the edges to it from a graph",
+			[]cli.Flag{
+				cli.StringFlag{Name: "label, l", Usage: "Label of the node to remove."},
+			},
+			func(c *cli.Context) Mutation {
+				return Mutation{Op: RemoveNode, Label: c.String("label")}
+			}),
+		mutationCommand("set-rule", "Replace the rule of a node of a graph",
+			[]cli.Flag{
+				cli.StringFlag{Name: "label, l", Usage: "Label of the node."},
+				cli.StringSliceFlag{Name: "rule", Value: &cli.StringSlice{}, Usage: "Label required by the new rule. Can be repeated. If not set, the rule is removed."},
+			},
+			func(c *cli.Context) Mutation {
+				return Mutation{Op: SetRule, Label: c.String("label"), Rule: c.StringSlice("rule")}
+			}),
+		cli.Command{
+			Name:        "check-incremental",
+			Usage:       "Check the incremental maintenance of active nodes against a full recomputation",
+			Description: "Applies random mutations to a generated graph, updating the active nodes incrementally, and checks after each mutation that they match a full recomputation, and every 100 mutations that a full recomputation matches the parallel engine with a single worker. Exits with a non-zero status on the first mismatch.",
+			Flags: []cli.Flag{
 				cli.IntFlag{
 					Name:   "size, s",
-					Value:  100,
-					Usage:  "The size of the graph for the simulation run. If input is set, this setting is ignored.",
+					Value:  1000,
+					Usage:  "The size of the generated graph.",
 					EnvVar: "SIM_SIZE",
 				},
+				cli.IntFlag{
+					Name:  "mutations, m",
+					Value: 1000,
+					Usage: "The number of random mutations to apply.",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Usage: "The seed of the random generator. If not set, the current time is used.",
+				},
+			},
+			Action: CheckIncremental,
+		},
+		cli.Command{
+			Name:  "renumber",
+			Usage: "Renumber and merge graph files",
+			Description: `Reads one or more graph files, resolving the children given by label, and writes them as a single graph with the nodes numbered by position.
+   Children given by position refer to nodes of the same file, children given by label can refer to nodes of any of the files.`,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "input, i",
+					Value: &cli.StringSlice{},
+					Usage: "Path to json file containing a graph. Can be repeated to merge graphs.",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "./data/{size}.json",
+					Usage: "Path to output json of the renumbered graph. " + outputUsage,
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Replace output if it already exists.",
+				},
+				cli.StringFlag{
+					Name:  "order",
+					Value: "input",
+					Usage: "Order of the nodes in the output: input, label or bfs from the first node. The first node stays first.",
+				},
+				cli.BoolFlag{
+					Name:  "labels",
+					Usage: "Write the children of the nodes by label instead of by position.",
+				},
+			},
+			Action: RenumberGraph,
+		},
+		cli.Command{
+			Name:  "compile",
+			Usage: "Compile a knowledge graph text file to a graph file",
+			Description: `Compiles a file written in the knowledge graph language to the json graph format. For example:
+
+   # Comments start with #
+   seed fever
+   fever -> infection, flu
+   flu requires cough & fever
+   include "symptoms.kg"
+   namespace med {
+       cold -> .fever
+   }`,
+			Flags: []cli.Flag{
 				cli.StringFlag{
 					Name:  "input, i",
+					Value: "./data/data.kg",
+					Usage: "Path to the knowledge graph file to compile.",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
 					Value: "./data/data.json",
-					Usage: "Path to json file containing data set. If not set, a random data set is used.",
+					Usage: "Path to output json of the compiled graph. " + outputUsage,
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Replace output if it already exists.",
+				},
+				cli.BoolFlag{
+					Name:  "labels",
+					Usage: "Write the children of the nodes by label instead of by position.",
+				},
+			},
+			Action: CompileGraph,
+		},
+		cli.Command{
+			Name:        "decompile",
+			Usage:       "Decompile a graph file to a knowledge graph text file",
+			Description: "Writes a json graph in the knowledge graph language, see the compile command.",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Value: "./data/data.json",
+					Usage: "Path to json file containing the graph to decompile.",
 				},
 				cli.StringFlag{
 					Name:  "output, o",
-					Value: "./data/{SEED_Value}.json",
-					Usage: "Path to output json of data set used.",
+					Value: "./data/data.kg",
+					Usage: "Path to output knowledge graph file. " + outputUsage,
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Replace output if it already exists.",
 				},
 			},
-			Action: TestSimulation,
+			Action: DecompileGraph,
 		},
 		cli.Command{
-			Name:        "concurrent",
-			Usage:       "Run a concurrent version of the test simulation.",
-			Description: `Runs a concurrent version of the test simulation with specified parameters and prints out the amount of time taken to run, excluding setup.`,
+			Name:  "export",
+			Usage: "Export a graph to Graphviz DOT, GraphML or GEXF",
+			Description: `Exports a graph for visualisation. Rule gated nodes are drawn as boxes and the labels of their rules are linked to them by dashed edges.
+   If result is set, the nodes active in the result are overlaid, colored from red at step 0 to blue at the last step. Otherwise if depth is set, the nodes active within depth from the seeds are overlaid the same way.
+   If around is set, only the nodes within radius edges of the node are exported.`,
 			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Value: "./data/data.json",
+					Usage: "Path to json file containing the graph to export.",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "./data/{size}.dot",
+					Usage: "Path to output file. " + outputUsage,
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Replace output if it already exists.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Output format: dot, graphml or gexf. If not set, it is taken from the extension of output.",
+				},
+				cli.StringFlag{
+					Name:  "result, r",
+					Usage: "Path to a result file of a run over the graph to overlay, see the result command.",
+				},
+				cli.IntFlag{
+					Name:  "depth, d",
+					Usage: "The depth of the run overlaid on the graph. With result, the nodes activated after depth are not overlaid.",
+				},
+				cli.StringSliceFlag{
+					Name:  "seed",
+					Value: &cli.StringSlice{},
+					Usage: "Label of a node active at step 0 of the overlaid run. Can be repeated. If not set, the first node of the graph is used. Ignored if result is set.",
+				},
+				cli.StringFlag{
+					Name:  "around",
+					Usage: "Label of the node the exported subgraph is centered on.",
+				},
+				cli.IntFlag{
+					Name:  "radius",
+					Value: 2,
+					Usage: "The number of edges, in either direction, from the around node to the exported nodes.",
+				},
+			},
+			Action: ExportGraph,
+		},
+		cli.Command{
+			Name:  "import",
+			Usage: "Import a graph from a CSV or TSV edge list, GraphML, N-Triples or Turtle",
+			Description: `Imports a graph from another format, numbering the nodes in the order they first appear.
+   csv, tsv: one edge per record with the columns source, target and rule, or as named by a header. The rule lists labels
+             separated by & gating the target, or the source if the target is empty.
+   graphml:  nodes are labelled by their label data or their id. Rule data and edges of kind rule, as written by export, gate nodes.
+   nt, ttl:  subjects and objects are labels. Triples with a rule predicate add the object to the rule of the subject, the
+             others are edges, only for the edge predicates if any are given. Predicates are given as IRIs or local names.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "Path to the file to import.",
+				},
+				cli.StringFlag{
+					Name:  "output, o",
+					Value: "./data/{size}.json",
+					Usage: "Path to output json of the imported graph. " + outputUsage,
+				},
+				cli.BoolFlag{
+					Name:  "force, f",
+					Usage: "Replace output if it already exists.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Usage: "Input format: csv, tsv, graphml, nt or ttl. If not set, it is taken from the extension of input.",
+				},
+				cli.BoolFlag{
+					Name:  "header",
+					Usage: "The first record of a csv or tsv file names the columns.",
+				},
+				cli.StringSliceFlag{
+					Name:  "edge-predicate",
+					Value: &cli.StringSlice{},
+					Usage: "Predicate of the triples imported as edges. Can be repeated. If not set, all the predicates that are not rule predicates.",
+				},
+				cli.StringSliceFlag{
+					Name:  "rule-predicate",
+					Value: &cli.StringSlice{},
+					Usage: "Predicate of the triples imported as rules. Can be repeated.",
+				},
+				cli.StringFlag{
+					Name:  "seed",
+					Usage: "Label of the node to put first, the seed of the simulations. If not set, the first node imported.",
+				},
+				cli.BoolFlag{
+					Name:  "labels",
+					Usage: "Write the children of the nodes by label instead of by position.",
+				},
+			},
+			Action: ImportGraph,
+		},
+		cli.Command{
+			Name:  "stats",
+			Usage: "Print statistics of a graph",
+			Description: `Prints the node and edge counts, the degree distributions, the depth of the nodes reachable from the seeds,
+   the strongly connected components, the rules and an estimate of the memory used by the graph and a run.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "Path to input json of graph.",
+				},
+				cli.StringSliceFlag{
+					Name:  "seed",
+					Value: &cli.StringSlice{},
+					Usage: "Label of a seed to measure depth from. Can be repeated. If not set, the first node.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "Output format: text or json.",
+				},
+			},
+			Action: GraphStatistics,
+		},
+		cli.Command{
+			Name:  "analyze",
+			Usage: "Find the nodes that can never be activated from the seeds",
+			Description: `Finds without running a simulation the nodes that can never be activated from the seeds, and prints each
+   with the chain of reasons that explains it: a node with no parents, a rule requiring an unknown label, a rule whose
+   labels are activated after the parents reach the node, as a rule is only checked then, a cycle of rules or a cycle
+   of edges no seed leads into. A rule requiring a label activated at the step the parents reach the node is reported
+   apart, as the simulations may activate the node depending on the order they visit the nodes of the step in.
+   With --depth, the nodes activated after the depth are reported too.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "Path to input json of graph.",
+				},
+				cli.StringSliceFlag{
+					Name:  "seed",
+					Value: &cli.StringSlice{},
+					Usage: "Label of a seed. Can be repeated. If not set, the first node.",
+				},
+				cli.IntFlag{
+					Name:  "depth, d",
+					Usage: "Depth of the simulations. If not set, unbounded.",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "Output format: text or json.",
+				},
+			},
+			Action: AnalyzeGraph,
+		},
+		cli.Command{
+			Name:  "requires",
+			Usage: "Find the minimal sets of seeds that activate a node",
+			Description: `Chains backward from the target to the minimal sets of seeds that activate it within the depth, smallest
+   first, with the rules satisfied on the way. A set is minimal if none of its seeds can be removed.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "Path to input json of graph.",
+				},
+				cli.StringFlag{
+					Name:  "target, t",
+					Usage: "Label of the node to activate.",
+				},
+				cli.IntFlag{
+					Name:  "depth, d",
+					Value: 100,
+					Usage: "The depth within which the target is activated.",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Value: 10,
+					Usage: "Maximum number of seed sets.",
+				},
+			},
+			Action: RequiresQuery,
+		},
+		cli.Command{
+			Name:  "why-not",
+			Usage: "Explain why a node is not activated from seeds",
+			Description: `Prints how the target is activated from the seeds within the depth, or why it is not and the minimal sets
+   of seeds to add to activate it.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "input, i",
+					Usage: "Path to input json of graph.",
+				},
+				cli.StringFlag{
+					Name:  "target, t",
+					Usage: "Label of the node to explain.",
+				},
+				cli.StringSliceFlag{
+					Name:  "seed",
+					Value: &cli.StringSlice{},
+					Usage: "Label of a seed. Can be repeated. If not set, the first node.",
+				},
+				cli.IntFlag{
+					Name:  "depth, d",
+					Value: 100,
+					Usage: "The depth within which the target is activated.",
+				},
+				cli.IntFlag{
+					Name:  "limit",
+					Value: 10,
+					Usage: "Maximum number of seed sets to add.",
+				},
+			},
+			Action: WhyNotQuery,
+		},
+		cli.Command{
+			Name:  "diff",
+			Usage: "Compare the active nodes of two runs",
+			Description: `Runs two graph files with the same engine, or a graph file with two engines, and lists the nodes gained,
+   lost and activated at another step by the second run. The change showing at the earliest step is explained: a node,
+   edge or rule missing from the other graph, or an activation the engine of the other run missed.
+   Engines: test, concurrent, concurrent-ring, parallel, or closure for the deterministic activation used by the incremental
+   updates.`,
+			Flags: []cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "input, i",
+					Value: &cli.StringSlice{},
+					Usage: "Path to input json of graph. Give it twice to compare two graphs.",
+				},
+				cli.StringSliceFlag{
+					Name:  "engine, e",
+					Value: &cli.StringSlice{},
+					Usage: "Engine of the runs: test, concurrent, parallel or closure. Give it twice to compare two engines. If not set, test.",
+				},
 				cli.IntFlag{
 					Name:   "depth, d",
 					Value:  100,
@@ -59,38 +454,445 @@ func main() {
 					EnvVar: "SIM_DEPTH",
 				},
 				cli.IntFlag{
-					Name:   "size, s",
-					Value:  100,
-					Usage:  "The size of the graph for the simulation run. If input is set, this setting is ignored.",
-					EnvVar: "SIM_SIZE",
+					Name:  "routines, r",
+					Value: 5,
+					Usage: "The number of routines used by the concurrent and parallel engines.",
+				},
+				cli.IntFlag{
+					Name:  "buffer, b",
+					Usage: "The buffer size of the channels of the concurrent engine. If not set it is scaled to graph size: size * 10",
+				},
+				cli.IntFlag{
+					Name:  "batch",
+					Value: 64,
+					Usage: "The number of nodes sent at once over the channels of the concurrent engine.",
+				},
+				cli.BoolFlag{
+					Name:  "exit-code",
+					Usage: "Exit with a non-zero status if the runs differ.",
+				},
+			},
+			Action: DiffCommand,
+		},
+		cli.Command{
+			Name:  "result",
+			Usage: "Print, compare and verify result files",
+			Description: `A result file is written by the simulations with --result. It holds the fingerprint of the graph, the engine,
+   seeds and depth of the simulation, the active nodes with the step at which they were activated and the time taken.`,
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "print",
+					Usage: "Print a result file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input, i",
+							Usage: "Path to the result file.",
+						},
+						cli.BoolFlag{
+							Name:  "actives",
+							Usage: "Print the active nodes with their step.",
+						},
+					},
+					Action: PrintResult,
+				},
+				cli.Command{
+					Name:  "diff",
+					Usage: "Compare the active nodes of two result files",
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "input, i",
+							Value: &cli.StringSlice{},
+							Usage: "Path to a result file. Give it twice.",
+						},
+						cli.StringSliceFlag{
+							Name:  "graph, g",
+							Value: &cli.StringSlice{},
+							Usage: "Path to the graph of the results, or of each result if given twice, to explain the first divergence.",
+						},
+						cli.BoolFlag{
+							Name:  "exit-code",
+							Usage: "Exit with a non-zero status if the results differ.",
+						},
+					},
+					Action: DiffResults,
+				},
+				cli.Command{
+					Name:  "verify",
+					Usage: "Check that a result is consistent with a graph",
+					Description: `Checks the fingerprint of the graph and that every active node is a seed or has a parent active at an earlier
+   step and the labels of its rule active, and that no step is after the depth except for the sequential engine, whose
+   depth counts passes. Results of the closure engine must match the closure exactly, with the labels of the rules
+   active at an earlier step. Exits with a non-zero status if a problem is found.`,
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "input, i",
+							Usage: "Path to the result file.",
+						},
+						cli.StringFlag{
+							Name:  "graph, g",
+							Usage: "Path to input json of graph.",
+						},
+					},
+					Action: VerifyResult,
+				},
+			},
+		},
+		cli.Command{
+			Name:  "verify",
+			Usage: "Check that files were produced from a graph: verify -g graph.json [file...]",
+			Description: `Prints the hash of the graph, the SHA-256 of a canonical serialization that does not depend on the formatting
+   of the graph file, and checks it against the fingerprint of the result files and the hash embedded in the other files,
+   such as exports and decompiled graphs. Exits with a non-zero status if one of them does not match.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "graph, g",
+					Usage: "Path to input json of graph.",
+				},
+				cli.StringFlag{
+					Name:  "hash",
+					Usage: "Expected hash of the graph.",
+				},
+			},
+			Action: VerifyFiles,
+		},
+		cli.Command{
+			Name:  "bench",
+			Usage: "Compare the time taken by the engines",
+			Description: `Runs each engine over each graph, with each number of workers for the concurrent and parallel engines and
+   each batch size for the concurrent engine, and prints the mean and minimum time taken over the trials after a run to
+   warm up, with the speedup over the first row. The profiles cover all the runs, including the warm up runs.
+   Engines: test, concurrent, concurrent-ring, parallel and closure.`,
+			Flags:  benchFlags(),
+			Action: BenchEngines,
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "save",
+					Usage: "Store the measurements of the engines as baselines",
+					Description: `Measures the engines like the bench command and stores the times of each engine and options on each graph
+   as a baseline in the baselines directory, keyed by machine, engine and options, and the fingerprint of the graph.
+   The graphs must be given with --input, the labels of generated graphs are random so their fingerprint changes.`,
+					Flags: baselineFlags(
+						cli.StringFlag{
+							Name:  "baselines",
+							Value: "./baselines",
+							Usage: "The directory of the baselines.",
+						},
+						cli.BoolFlag{
+							Name:  "force, f",
+							Usage: "Replace the existing baselines.",
+						},
+					),
+					Action: BenchSave,
+				},
+				cli.Command{
+					Name:  "compare",
+					Usage: "Compare the engines against their baselines",
+					Description: `Measures the engines like the bench command and compares the times with the baselines of this machine with a
+   one-sided Mann-Whitney U test. A measurement is a regression if it is slower with a p-value below --alpha and its
+   median time is more than --threshold slower than the median of the baseline. Exits with status 1 on a regression,
+   or if there are too few trials on a side for the test to reach a p-value below --alpha: at least 4 trials on each
+   side for 0.05.`,
+					Flags: baselineFlags(
+						cli.StringFlag{
+							Name:  "baselines",
+							Value: "./baselines",
+							Usage: "The directory of the baselines.",
+						},
+						cli.Float64Flag{
+							Name:  "threshold",
+							Value: 0.1,
+							Usage: "The slowdown of the median time over the baseline flagged, 0.1 for 10%.",
+						},
+						cli.Float64Flag{
+							Name:  "alpha",
+							Value: 0.05,
+							Usage: "The significance level of the test.",
+						},
+					),
+					Action: BenchCompare,
+				},
+			},
+		},
+		cli.Command{
+			Name:  "run",
+			Usage: "Run a simulation with any engine",
+			Description: `Runs a simulation with the engine given and prints out the amount of time taken to run, excluding setup.
+   Engines: sequential (also named test), concurrent, concurrent-ring, parallel, closure and auto. The concurrent-ring
+   engine is the concurrent engine with lock free queues of the buffer size, rounded up to a power of 2, in place of its
+   channels. Auto picks the sequential engine for graphs smaller than the crossover measured by the calibrate command,
+   scaled by their average degree, and the engine and number of workers calibrated for larger ones. Without a
+   calibration the crossover is 1000 nodes.`,
+			Flags: simulationFlags(
+				cli.StringFlag{
+					Name:  "engine, e",
+					Value: "auto",
+					Usage: "The engine to run: auto, " + strings.Join(engineNames(), ", ") + ".",
 				},
 				cli.IntFlag{
 					Name:  "procs, p",
-					Value: 1,
 					Usage: "The number of processors to be used by the runtime. Can also be set using env var GOMAXPROCS",
 				},
 				cli.IntFlag{
-					Name:  "routines, r",
-					Value: 5,
-					Usage: "The number of routines to be used by the simulation. Best to set <= procs",
+					Name:  "workers, w",
+					Value: runtime.NumCPU(),
+					Usage: "The number of goroutines of the concurrent and parallel engines. If not set, auto picks it.",
 				},
 				cli.IntFlag{
 					Name:  "buffer, b",
+					Usage: "The buffer size of the channels of the concurrent engine. If not set it is scaled to graph size: size * 10",
+				},
+				cli.IntFlag{
+					Name:  "batch",
+					Value: 64,
+					Usage: "The number of nodes sent at once over the channels of the concurrent engine. If not set, auto uses the calibrated one.",
+				},
+				cli.StringFlag{
+					Name:  "calibration",
+					Value: "./calibration.json",
+					Usage: "Path to the calibration used by auto, see the calibrate command.",
+				},
+			),
+			Action: RunSimulation,
+		},
+		cli.Command{
+			Name:  "calibrate",
+			Usage: "Measure the crossover used by run --engine auto",
+			Description: `Times the sequential, concurrent and parallel engines on generated graphs of each size and stores the
+   smallest size from which the fastest of the concurrent and parallel engines on the largest graph beats the sequential
+   engine on every larger graph. The concurrent and parallel engines are timed with each number of workers and keep the
+   fastest, the fewest workers on a tie, and the workers of the engine stored are its fastest on the largest graph.
+   The calibration is for the cores and GOMAXPROCS of this machine. The profiles cover all the runs.`,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "size, s",
+					Value: "100,300,1000,3000,10000,30000,100000",
+					Usage: "Comma separated sizes of the generated graphs, in increasing order.",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Value: 1,
+					Usage: "The seed of the random generator of the graphs.",
+				},
+				cli.IntFlag{
+					Name:   "depth, d",
+					Value:  100,
+					Usage:  "The depth for each simulation run",
+					EnvVar: "SIM_DEPTH",
+				},
+				cli.IntFlag{
+					Name:  "trials, t",
+					Value: 3,
+					Usage: "The number of timed runs of each engine on each size.",
+				},
+				cli.StringFlag{
+					Name:  "workers, w",
+					Usage: "Comma separated numbers of goroutines of the concurrent and parallel engines to time. If not set, the powers of 2 below the number of cores and the number of cores.",
+				},
+				cli.IntFlag{
+					Name:  "batch",
+					Value: 64,
+					Usage: "The number of nodes sent at once over the channels of the concurrent engine.",
+				},
+				cli.StringFlag{
+					Name:  "calibration",
+					Value: "./calibration.json",
+					Usage: "Path to write the calibration to. It is replaced if it exists.",
+				},
+			}, profileFlags...),
+			Action: Calibrate,
+		},
+		cli.Command{
+			Name:  "experiment",
+			Usage: "Run sweeps of simulations described by experiment files",
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "run",
+					Usage: "Run every simulation of an experiment file: experiment run [--dir dir] file",
+					Description: `Runs each combination of the datasets and generated graphs, engines, depths, routines, buffer and batch
+   sizes of the experiment, repeated, and writes the result of each run to the runs directory of the results directory,
+   along with a copy of the experiment file and the generated graphs. A run whose result is already written is skipped,
+   so an interrupted sweep resumes where it stopped when run again with the same file.
+   Experiment files are JSON, or YAML if their extension is .yaml or .yml, with the keys name, datasets, generators
+   (each with a type rules, tree or random, a branching factor, sizes and a seed), engines, depths, routines, buffers,
+   batches, repetitions and sweeps. Each sweep, if any, restricts the combinations to the graphs of its sizes and sets
+   some of the other keys, a run common to several sweeps being run once.
+   The profiles cover all the runs, with the writing of their results in between.`,
+					Flags: append([]cli.Flag{
+						cli.StringFlag{
+							Name:  "dir",
+							Usage: "The results directory. If not set, ./results/ followed by the name of the experiment.",
+						},
+					}, profileFlags...),
+					Action: ExperimentRun,
+				},
+			},
+		},
+		cli.Command{
+			Name:  "report",
+			Usage: "Write the tables and plots of the paper from result files: report [--dir dir] results...",
+			Description: `Reads the result files given, and the result files under the directories given such as the results of an
+   experiment, and writes to the output directory:
+     runtime.tex           a LaTeX tabular of the mean runtime of each engine on each size of graph
+     runtime-size.svg      the runtime of each engine against the size of the graph
+     speedup-routines.svg  the speedup of the engines with workers on the largest graph against their routines
+     actives-depth.svg     the active nodes of each engine on the largest graph against the depth
+   The results of a configuration are averaged. Runtimes are compared at the largest depth of the results, with the
+   fastest configuration of each engine. The test engine is reported as sequential.`,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "dir",
+					Value: "./paper/generated",
+					Usage: "The output directory. Its files are replaced.",
+				},
+			},
+			Action: ReportCommand,
+		},
+		cli.Command{
+			Name:  "store",
+			Usage: "Manage a persistent graph store",
+			Description: `A store keeps a graph in a directory as a snapshot and a write ahead log of the mutations applied since.
+   Mutations are added to a store with the mutation commands and their --store flag.`,
+			Subcommands: []cli.Command{
+				cli.Command{
+					Name:  "init",
+					Usage: "Create a store from a graph",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "dir",
+							Usage: "Directory of the store.",
+						},
+						cli.StringFlag{
+							Name:  "input, i",
+							Usage: "Path to json file containing the initial graph. If not set, the store starts empty.",
+						},
+					},
+					Action: StoreInit,
+				},
+				cli.Command{
+					Name:  "snapshot",
+					Usage: "Write a snapshot of a store and compact its log",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "dir",
+							Usage: "Directory of the store.",
+						},
+					},
+					Action: StoreSnapshot,
+				},
+				cli.Command{
+					Name:  "export",
+					Usage: "Write the graph of a store to a json file",
+					Flags: []cli.Flag{
+						cli.StringFlag{
+							Name:  "dir",
+							Usage: "Directory of the store.",
+						},
+						cli.StringFlag{
+							Name:  "output, o",
+							Value: "./data/data.json",
+							Usage: "Path to output json of the graph. " + outputUsage,
+						},
+						cli.BoolFlag{
+							Name:  "force, f",
+							Usage: "Replace output if it already exists.",
+						},
+						cli.BoolFlag{
+							Name:  "labels",
+							Usage: "Write the children of the nodes by label instead of by position.",
+						},
+					},
+					Action: StoreExport,
+				},
+			},
+		},
+		cli.Command{
+			Name:        "check-store",
+			Usage:       "Check the recovery of a store after simulated crashes",
+			Description: "Applies random mutations to a store in a temporary directory, simulating crashes while writing the log, a snapshot or compacting, and checks after each recovery that the store contains exactly the acknowledged mutations. Exits with a non-zero status on the first mismatch.",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:   "size, s",
+					Value:  100,
+					Usage:  "The size of the generated graph.",
+					EnvVar: "SIM_SIZE",
+				},
+				cli.IntFlag{
+					Name:  "crashes, c",
 					Value: 100,
-					Usage: "The buffer size used by the communication channel between goroutines. If not set it is scaled to graph size: size * 10",
+					Usage: "The number of crashes to simulate.",
+				},
+				cli.IntFlag{
+					Name:  "snapshot",
+					Value: 10,
+					Usage: "The number of mutations after which a snapshot is taken.",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Usage: "The seed of the random generator. If not set, the current time is used.",
 				},
+			},
+			Action: CheckStore,
+		},
+		cli.Command{
+			Name:  "check-engine",
+			Usage: "Check that an engine finishes every run",
+			Description: `Runs an engine over a graph many times and exits with a non-zero status on the first run that does not
+   finish within the timeout. Small batches and many workers make the races between the goroutines of the concurrent
+   engines more likely. The engines using buffers are then checked again with buffers of 1 and batches of 1, where the
+   goroutines most often find no room to send.`,
+			Flags: []cli.Flag{
 				cli.StringFlag{
-					Name:  "input, i",
-					Value: "./data/data.json",
-					Usage: "Path to json file containing data set. If not set, a random data set is used.",
+					Name:  "engine, e",
+					Value: "concurrent",
+					Usage: "The engine to check: " + strings.Join(engineNames(), ", ") + ".",
 				},
 				cli.StringFlag{
-					Name:  "output, o",
-					Value: "./data/{SEED_Value}.json",
-					Usage: "Path to output json of data set used.",
+					Name:  "input, i",
+					Usage: "Path to json file containing a graph. If not set, a graph is generated.",
+				},
+				cli.IntFlag{
+					Name:   "size, s",
+					Value:  1000,
+					Usage:  "The size of the generated graph.",
+					EnvVar: "SIM_SIZE",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Value: 1,
+					Usage: "The seed of the random generator of the graph.",
+				},
+				cli.IntFlag{
+					Name:   "depth, d",
+					Value:  100,
+					Usage:  "The depth for each simulation run",
+					EnvVar: "SIM_DEPTH",
+				},
+				cli.IntFlag{
+					Name:  "workers, w",
+					Value: 8,
+					Usage: "The number of workers of the engine.",
+				},
+				cli.IntFlag{
+					Name:  "buffer, b",
+					Usage: "The buffer size of the engine. If not set it is scaled to graph size: size * 10",
+				},
+				cli.IntFlag{
+					Name:  "batch",
+					Value: 2,
+					Usage: "The number of nodes sent at once by the engine.",
+				},
+				cli.IntFlag{
+					Name:  "runs, n",
+					Value: 500,
+					Usage: "The number of runs.",
+				},
+				cli.DurationFlag{
+					Name:  "timeout",
+					Value: 10 * time.Second,
+					Usage: "The time after which a run is considered hung.",
 				},
 			},
-			Action: ConcurrentTestSimulation,
+			Action: CheckEngine,
 		},
 	}
 
@@ -102,101 +904,46 @@ func main() {
 	app.Run(os.Args)
 }
 
-func TestSimulation(c *cli.Context) {
-	var graph []*LabelNode
-
-	depth := c.Int("depth")
-	size := c.Int("size")
-
-	if c.IsSet("input") {
-		graph = load(c.String("input"))
-		size = len(graph)
-		fmt.Println("Graph Loaded")
-	} else {
-		seed := time.Now().UnixNano()
-		//graph = generateRandomGraph(size, seed)
-		graph = generateRandomTreeWithRules(4, size, seed)
-		size = len(graph)
-		fmt.Println("Graph generated")
-	}
-	// reset Visited to false
-	for i := range graph {
-		graph[i].Visited = false
-	}
-
-	fmt.Printf("Simulation Info:\nDepth: %d\nGraph Size: %d\n", depth, size)
-
-	var actives map[string]*LabelNode = map[string]*LabelNode{
-		graph[0].Label: graph[0],
-	}
-
-	start := time.Now()
+// Simulate runs the test simulation over the graph from its first node.
+func Simulate(graph []*LabelNode, depth int) *Run {
+	run := NewRun(graph)
+	run.Activate(graph[0], 0)
 
 	for i := 0; i < depth; i++ {
-		//spew.Dump(actives)
-		for _, node := range actives {
-			if !node.Visited {
-				node.Visited = true
+		//spew.Dump(run.Actives)
+		for _, node := range run.Actives {
+			if run.Visit(node) {
 				for _, childId := range node.Children {
 					child := graph[childId]
-					if child.Rule == nil || Interpret(actives, child.Rule) {
-						actives[child.Label] = child
+					if child.Rule == nil || Interpret(run.Actives, child.Rule) {
+						run.Activate(child, run.Step(node)+1)
 					}
 				}
 			}
 		}
 	}
-	elapsed := time.Since(start)
-	fmt.Printf("Num actives: %d\n", len(actives))
-	fmt.Printf("Time taken: %s\n", elapsed)
-	if c.IsSet("output") {
-		output(graph, c.String("output"))
-	}
+	return run
 }
 
+// SimulateConcurrent runs the concurrent version of the test simulation over the graph
+// from its first node, with the given number of worker goroutines and size of the
+// buffers of the channels between them. The goroutines exchange the nodes in batches
+// of up to batchSize ids, so a channel send is paid once per batch instead of once per
+// child, and the buffers of the channels are counted in batches.
 // This version is non deterministic because of race conditions between goroutines to process
 // the nodes received.
-// When giving the right result, it typically process the same result as non-concurrent version faster.
-func ConcurrentTestSimulation(c *cli.Context) {
-	var graph []*LabelNode
-
-	depth := c.Int("depth")
-	size := c.Int("size")
-	var processors int = -1
-	channelBufferSize := c.Int("buffer")
-
-	if c.IsSet("input") {
-		graph = load(c.String("input"))
-		size = len(graph)
-		fmt.Println("Graph Loaded")
-	} else {
-		seed := time.Now().UnixNano()
-		//graph = generateRandomGraph(size, seed)
-		graph = generateRandomTreeWithRules(4, size, seed)
-		size = len(graph)
-		fmt.Println("Graph generated")
-	}
-	// reset Visited to false
-	for i := range graph {
-		graph[i].Visited = false
-	}
-
-	if c.IsSet("procs") {
-		processors = c.Int("procs")
-		runtime.GOMAXPROCS(processors)
-	}
-
-	fmt.Printf("Simulation Info:\nDepth: %d\nGraph Size: %d\nNum of Cores: %d\nGOMAXPROCS: %d\nConcurrent Routines: %d\n", depth, size, runtime.NumCPU(), runtime.GOMAXPROCS(-1), c.Int("routines"))
-
-	var actives map[string]*LabelNode = make(map[string]*LabelNode)
+func SimulateConcurrent(graph []*LabelNode, depth, routines, channelBufferSize, batchSize int) *Run {
+	return simulateConcurrent(graph, depth, routines, batchSize,
+		newChannelTransport(channelBufferSize), newChannelTransport(channelBufferSize))
+}
 
-	if !c.IsSet("buffer") {
-		channelBufferSize = size * 10
+// simulateConcurrent runs the concurrent simulation with the transports given from
+// the workers to the collector and from the collector to the workers.
+func simulateConcurrent(graph []*LabelNode, depth, routines, batchSize int, collect, sendWorkers transport) *Run {
+	run := NewRun(graph)
+	if batchSize < 1 {
+		batchSize = 1
 	}
-	collect := make(chan *LabelNode, channelBufferSize)
-	sendWorkers := make(chan *LabelNode, channelBufferSize)
-
-	waitGroup := new(sync.WaitGroup)
 
 	// NOTE: No locking is used on the data structures until a more elegant solution is found for
 	// concurrent communication on the graph
@@ -204,76 +951,142 @@ func ConcurrentTestSimulation(c *cli.Context) {
 	// DEPRECATED locks
 	// Actives mutex is used for reading the actives map in interpreting rules for
 	// nodes with rules.
-	// It is unnecessary to have a mutex on graph since at most 1 goroutine can access a
-	// node that is not yet in actives. Once a node is labeled as visited and added to the
-	// actives, it is sent to the worker routines.
+	// It is unnecessary to have a mutex on graph since the graph is never modified. The
+	// run is only modified by the collector. Once a node is labeled as visited and added
+	// to the actives, it is sent to the worker routines.
 	// activesMutex := new(sync.RWMutex)
 
 	// Assumptions
 	// Note: Unnecessary to use mutexes if only one routine interprets
 	// Note: Also unnecessary as long as nodes can only be modified in 1 goroutine
 
-	start := time.Now()
+	// pending counts the nodes sent to the collector or to the workers, buffered in a
+	// batch or in a channel, and not yet processed. The simulation is over when it drops
+	// to 0, done is then closed to stop all the goroutines.
+	pending := int64(1)
+	done := make(chan struct{})
+	var finish sync.Once
+	processed := func(n int) {
+		if atomic.AddInt64(&pending, int64(-n)) == 0 {
+			finish.Do(func() { close(done) })
+		}
+	}
+	// send sends the batch unless the simulation is over, and returns a new empty batch.
+	send := func(to transport, batch []task) []task {
+		to.send(batch, done)
+		return make([]task, 0, batchSize)
+	}
+	// next returns the next batch from the transport. If none is waiting, the partial
+	// batch held is sent first, as a goroutine waiting while it holds nodes could wait
+	// forever: the nodes are pending, so the simulation would never be over. Checking
+	// that the transport is empty before waiting is not enough, as another worker can
+	// take the batch in between.
+	next := func(from transport, held *[]task, to transport) ([]task, bool) {
+		if batch, ok := from.tryReceive(); ok {
+			return batch, true
+		}
+		if len(*held) > 0 {
+			*held = send(to, *held)
+		}
+		return from.receive(done)
+	}
 
-	collect <- graph[0]
+	collect.send([]task{{id: 0, step: 0}}, done)
 
 	// Create the collector goroutine that collects the active nodes
 	// and send them to the workers the node received has not been visited.
-	// It is the only goroutine allowed to do any mutation on the graph, actives
-	// or any nodes
-	go func(collect <-chan *LabelNode, sendWorkers chan<- *LabelNode) {
+	// It is the only goroutine allowed to do any mutation on the run, it stops when
+	// done is closed so that the run can be read once the workers are done.
+	// A batch of activated nodes is queued for the workers once full, or as soon as
+	// there is nothing left to collect so that they never wait on a partial batch.
+	// The collector never waits to send: the workers wait to send to it, so with both
+	// buffers full they would wait on each other forever. The batches the workers have
+	// no room for are kept in the outbox, which is unbounded, and sent while the
+	// collector waits for the next batch to collect.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		actives := make([]task, 0, batchSize)
+		var outbox [][]task
 		for {
-			select {
-			case newActive := <-collect:
-				if !newActive.Visited {
-					newActive.Visited = true
-					if newActive.Rule == nil || Interpret(actives, newActive.Rule) {
-						actives[newActive.Label] = newActive
-						sendWorkers <- newActive
+			for len(outbox) > 0 && sendWorkers.trySend(outbox[0]) {
+				outbox[0], outbox = nil, outbox[1:]
+			}
+			batch, ok := collect.tryReceive()
+			if !ok {
+				if len(actives) > 0 {
+					outbox = append(outbox, actives)
+					actives = make([]task, 0, batchSize)
+				}
+				if len(outbox) == 0 {
+					if batch, ok = collect.receive(done); !ok {
+						return
+					}
+				} else {
+					var sent bool
+					if batch, sent, ok = sendOrReceive(sendWorkers, outbox[0], collect, done); !ok {
+						return
+					}
+					if sent {
+						outbox[0], outbox = nil, outbox[1:]
+						continue
 					}
 				}
 			}
+			dropped := 0
+			for _, t := range batch {
+				node := graph[t.id]
+				if run.Visit(node) && (node.Rule == nil || Interpret(run.Actives, node.Rule)) {
+					run.Activate(node, t.step)
+					actives = append(actives, t)
+					if len(actives) == batchSize {
+						outbox = append(outbox, actives)
+						actives = make([]task, 0, batchSize)
+					}
+				} else {
+					dropped++
+				}
+			}
+			processed(dropped)
 		}
-	}(collect, sendWorkers)
+	}()
 
-	// The worker routines receive a node on the receive channel and processes it and
-	// sends the children to the collect channel.
-	// The select statement takes a node from the receive channel if there is a value to be received.
-	// If there is none, the select statement blocks until either the timeout channel sends a value
-	// and terminates the goroutine or it receives a value from the receive channel.
-	// When it receives a value on the receive channel the timeout channel is reset.
-	// Timeout is currently 10 Milliseconds, which introduces a lower bound to the processing if more
-	// processing resources (goroutines or depth) is allocated to the simulation.
-	numGoroutines := c.Int("routines")
-	for i := 0; i < numGoroutines; i++ {
+	// The worker routines receive a batch of nodes from the collector, and send the
+	// children of the nodes activated before depth to the collector in batches,
+	// flushing the last one when there is no other batch to receive.
+	// A worker takes a batch if there is one to be received, and waits until there is
+	// one or the simulation is over otherwise.
+	waitGroup := new(sync.WaitGroup)
+	for i := 0; i < routines; i++ {
 		waitGroup.Add(1)
-		go func(collect chan<- *LabelNode, receive <-chan *LabelNode) {
-			timeout := time.After(10 * time.Millisecond)
-			for x := 0; x < depth; x++ {
-				select {
-				case node := <-receive:
-					for _, childId := range node.Children {
-						collect <- graph[childId]
-					}
-					timeout = time.After(10 * time.Millisecond)
-				case <-timeout:
-					waitGroup.Done()
+		go func(receive transport) {
+			defer waitGroup.Done()
+			children := make([]task, 0, batchSize)
+			for {
+				batch, ok := next(receive, &children, collect)
+				if !ok {
 					return
 				}
+				for _, t := range batch {
+					if t.step >= depth {
+						continue
+					}
+					for _, childId := range graph[t.id].Children {
+						atomic.AddInt64(&pending, 1)
+						children = append(children, task{id: childId, step: t.step + 1})
+						if len(children) == batchSize {
+							children = send(collect, children)
+						}
+					}
+				}
+				processed(len(batch))
 			}
-			waitGroup.Done()
-			return
-		}(collect, sendWorkers)
+		}(sendWorkers)
 	}
 
 	waitGroup.Wait()
-
-	elapsed := time.Since(start)
-	fmt.Printf("Num actives: %d\n", len(actives))
-	fmt.Printf("Time taken: %s\n", elapsed)
-	if c.IsSet("output") {
-		output(graph, c.String("output"))
-	}
+	<-stopped
+	return run
 }
 
 func Interpret(actives map[string]*LabelNode, rule []string) bool {
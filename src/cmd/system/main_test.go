@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// TestConcurrentBuffers runs the concurrent engines with buffers much smaller than the
+// frontier, where the goroutines most often find no room to send.
+func TestConcurrentBuffers(t *testing.T) {
+	graph := generateRandomTreeWithRules(4, 10000, 1)
+	cases := []Options{
+		{Depth: 100, Workers: 4, BufferSize: len(graph) * 10, BatchSize: 64},
+		{Depth: 100, Workers: 4, BufferSize: 100, BatchSize: 1},
+		{Depth: 100, Workers: 4, BufferSize: 1, BatchSize: 1},
+		{Depth: 100, Workers: 1, BufferSize: 1, BatchSize: 1},
+	}
+	for _, name := range []string{"concurrent", "concurrent-ring"} {
+		for _, opts := range cases {
+			if err := checkEngine(engines[name], graph, opts, 10, 10*time.Second); err != nil {
+				t.Errorf("%s with %+v: %v", name, opts, err)
+			}
+		}
+	}
+}
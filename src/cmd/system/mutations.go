@@ -0,0 +1,406 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"github.com/satori/go.uuid"
+	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+)
+
+// The operations supported by a Mutation.
+const (
+	AddNode    = "add-node"
+	AddEdge    = "add-edge"
+	RemoveNode = "remove-node"
+	SetRule    = "set-rule"
+)
+
+// Mutation is a single change to a graph. Nodes are referenced by label since ids
+// are not stable across mutations: removing a node renumbers every node after it.
+//
+//	add-node:    adds a node Label with the rule Rule and no children
+//	add-edge:    adds Target to the children of Label
+//	remove-node: removes Label and every edge to it
+//	set-rule:    replaces the rule of Label with Rule, an empty rule removes it
+type Mutation struct {
+	Op     string
+	Label  string
+	Target string   `json:",omitempty"`
+	Rule   []string `json:",omitempty"`
+}
+
+func (m Mutation) String() string {
+	switch m.Op {
+	case AddEdge:
+		return fmt.Sprintf("%s %s -> %s", m.Op, m.Label, m.Target)
+	case AddNode, SetRule:
+		return fmt.Sprintf("%s %s %v", m.Op, m.Label, m.Rule)
+	}
+	return fmt.Sprintf("%s %s", m.Op, m.Label)
+}
+
+// Apply returns a new graph with the mutation applied. The graph passed in is left
+// untouched, only the nodes that change are copied so runs can keep using the old
+// graph while the new one is built.
+func (m Mutation) Apply(graph []*LabelNode) ([]*LabelNode, error) {
+	switch m.Op {
+	case AddNode:
+		if indexOf(graph, m.Label) >= 0 {
+			return nil, fmt.Errorf("%s: node %s already exists", m.Op, m.Label)
+		}
+		newGraph := make([]*LabelNode, len(graph), len(graph)+1)
+		copy(newGraph, graph)
+		return append(newGraph, &LabelNode{
+			Id:    len(graph),
+			Label: m.Label,
+			Rule:  copyRule(m.Rule),
+		}), nil
+
+	case AddEdge:
+		from := indexOf(graph, m.Label)
+		if from < 0 {
+			return nil, fmt.Errorf("%s: node %s does not exist", m.Op, m.Label)
+		}
+		to := indexOf(graph, m.Target)
+		if to < 0 {
+			return nil, fmt.Errorf("%s: node %s does not exist", m.Op, m.Target)
+		}
+		for _, childId := range graph[from].Children {
+			if childId == to {
+				return nil, fmt.Errorf("%s: edge %s -> %s already exists", m.Op, m.Label, m.Target)
+			}
+		}
+		node := copyNode(graph[from])
+		node.Children = append(node.Children, to)
+		return replaceNode(graph, node), nil
+
+	case RemoveNode:
+		removed := indexOf(graph, m.Label)
+		if removed < 0 {
+			return nil, fmt.Errorf("%s: node %s does not exist", m.Op, m.Label)
+		}
+		newGraph := make([]*LabelNode, 0, len(graph)-1)
+		for i, node := range graph {
+			if i == removed {
+				continue
+			}
+			changed := i > removed
+			var children []int
+			for _, childId := range node.Children {
+				switch {
+				case childId == removed:
+					changed = true
+				case childId > removed:
+					children = append(children, childId-1)
+					changed = true
+				default:
+					children = append(children, childId)
+				}
+			}
+			if changed {
+				node = copyNode(node)
+				node.Id = len(newGraph)
+				node.Children = children
+			}
+			newGraph = append(newGraph, node)
+		}
+		return newGraph, nil
+
+	case SetRule:
+		i := indexOf(graph, m.Label)
+		if i < 0 {
+			return nil, fmt.Errorf("%s: node %s does not exist", m.Op, m.Label)
+		}
+		node := copyNode(graph[i])
+		node.Rule = copyRule(m.Rule)
+		return replaceNode(graph, node), nil
+	}
+	return nil, fmt.Errorf("unknown mutation %q", m.Op)
+}
+
+func indexOf(graph []*LabelNode, label string) int {
+	for i := range graph {
+		if graph[i].Label == label {
+			return i
+		}
+	}
+	return -1
+}
+
+func copyNode(node *LabelNode) *LabelNode {
+	newNode := *node
+	newNode.Children = append([]int(nil), node.Children...)
+	newNode.Rule = copyRule(node.Rule)
+	return &newNode
+}
+
+// copyRule copies a rule keeping an empty rule as nil, nodes without a rule are
+// always activated by their parents.
+func copyRule(rule []string) []string {
+	if len(rule) == 0 {
+		return nil
+	}
+	return append([]string(nil), rule...)
+}
+
+func replaceNode(graph []*LabelNode, node *LabelNode) []*LabelNode {
+	newGraph := make([]*LabelNode, len(graph))
+	copy(newGraph, graph)
+	newGraph[node.Id] = node
+	return newGraph
+}
+
+// mutationCommand builds the command applying a mutation to a graph file. The
+// mutation is built from the command flags by mutation.
+func mutationCommand(name, usage string, flags []cli.Flag, mutation func(c *cli.Context) Mutation) cli.Command {
+	return cli.Command{
+		Name:  name,
+		Usage: usage,
+		Description: usage + `. The graph is read from input and written back to output, which defaults to input.
+   If store is set, the mutation is appended to the log of the store instead.
+   If depth is set, the nodes active from the seeds are computed before the mutation and updated incrementally after it.`,
+		Flags: append(flags,
+			cli.StringFlag{
+				Name:  "input, i",
+				Value: "./data/data.json",
+				Usage: "Path to json file containing the graph to mutate.",
+			},
+			cli.StringFlag{
+				Name:  "output, o",
+				Usage: "Path to output json of the mutated graph. If not set, input is overwritten. " + outputUsage,
+			},
+			cli.BoolFlag{
+				Name:  "force, f",
+				Usage: "Replace output if it already exists.",
+			},
+			cli.BoolFlag{
+				Name:  "labels",
+				Usage: "Write the children of the nodes by label instead of by position.",
+			},
+			cli.StringFlag{
+				Name:  "store, dir",
+				Usage: "Directory of a store to apply the mutation to. If set, input and output are ignored.",
+			},
+			cli.IntFlag{
+				Name:  "depth, d",
+				Usage: "The depth used to report the active nodes before and after the mutation.",
+			},
+			cli.StringSliceFlag{
+				Name:  "seed",
+				Value: &cli.StringSlice{},
+				Usage: "Label of a node active at step 0. Can be repeated. If not set, the first node of the graph is used.",
+			},
+		),
+		Action: func(c *cli.Context) {
+			MutateGraph(c, mutation(c))
+		},
+	}
+}
+
+func MutateGraph(c *cli.Context, m Mutation) {
+	var graph []*LabelNode
+	var store *Store
+	if c.IsSet("store") {
+		store = openStore(c)
+		defer store.Close()
+		graph = store.Graph
+	} else {
+		graph = load(c.String("input"))
+	}
+
+	var activity *Activity
+	var before int
+	depth := c.Int("depth")
+	if c.IsSet("depth") {
+		seeds := c.StringSlice("seed")
+		if len(seeds) == 0 {
+			if len(graph) == 0 {
+				log.Fatalf("%s: the graph is empty, --depth needs a --seed", c.Command.Name)
+			}
+			seeds = []string{graph[0].Label}
+		}
+		activity = NewActivity(graph, seeds)
+		before = len(activity.Run(depth).Actives)
+	}
+
+	var err error
+	if store != nil {
+		err = store.Apply(m)
+		graph = store.Graph
+	} else {
+		graph, err = m.Apply(graph)
+	}
+	if _, ok := err.(*SnapshotError); ok {
+		log.Print(err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(m)
+
+	if activity != nil {
+		start := time.Now()
+		if err := activity.Apply(m); err != nil {
+			log.Fatal(err)
+		}
+		elapsed := time.Since(start)
+		fmt.Printf("Num actives before: %d\nNum actives after: %d\n", before, len(activity.Run(depth).Actives))
+		fmt.Printf("Time taken: %s\n", elapsed)
+	}
+
+	if store == nil {
+		if c.IsSet("output") {
+			outputGraph(c, graph, map[string]string{"size": strconv.Itoa(len(graph))})
+		} else if err := writeGraph(graph, c.String("input"), c.Bool("labels"), true); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// checkIncremental applies the random mutations to the graph and checks after each of
+// them that the incrementally updated Activity from the first node matches a full
+// recomputation, and every 100 mutations that it matches the parallel engine. It
+// returns the time taken by the incremental updates and by the full recomputations.
+func checkIncremental(graph []*LabelNode, r *rand.Rand, mutations int) (incremental, full time.Duration, err error) {
+	seeds := []string{graph[0].Label}
+	activity := NewActivity(graph, seeds)
+	for n := 0; n < mutations; n++ {
+		if n%100 == 0 {
+			if err := checkActivityEngine(activity.Graph); err != nil {
+				return incremental, full, fmt.Errorf("mismatch with the parallel engine before mutation %d: %v", n, err)
+			}
+		}
+
+		m := randomMutation(r, activity.Graph)
+
+		start := time.Now()
+		if err := activity.Apply(m); err != nil {
+			return incremental, full, err
+		}
+		incremental += time.Since(start)
+
+		start = time.Now()
+		expected := Closure(activity.Graph, seeds)
+		full += time.Since(start)
+
+		for i := range expected {
+			if expected[i] != activity.steps[i] {
+				return incremental, full, fmt.Errorf("mismatch after mutation %d (%s): node %s has step %d, expected %d",
+					n, m, activity.Graph[i].Label, activity.steps[i], expected[i])
+			}
+		}
+	}
+	return incremental, full, nil
+}
+
+// CheckIncremental runs checkIncremental on a generated graph.
+func CheckIncremental(c *cli.Context) {
+	seed := time.Now().UnixNano()
+	if c.IsSet("seed") {
+		seed = int64(c.Int("seed"))
+	}
+	if c.Int("size") < 1 {
+		log.Fatalf("%s: the size must be at least 1", c.Command.Name)
+	}
+	graph := generateRandomTreeWithRules(4, c.Int("size"), seed)
+	fmt.Printf("Seed: %d\nGraph Size: %d\nMutations: %d\n", seed, len(graph), c.Int("mutations"))
+
+	incremental, full, err := checkIncremental(graph, rand.New(rand.NewSource(seed)), c.Int("mutations"))
+	if err != nil {
+		fmt.Printf("Check failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Time taken incremental: %s\nTime taken full: %s\n", incremental, full)
+}
+
+// checkActivityEngine checks that an activity from the first node of the graph has
+// the steps of the parallel engine with a single worker, which expands the nodes in
+// the order they are activated, level by level like an activity. The labels whose
+// activation when a rule is checked depends on that order are removed first, see
+// withoutOrderedRules.
+func checkActivityEngine(graph []*LabelNode) error {
+	if len(graph) == 0 {
+		return nil
+	}
+	seeds := []string{graph[0].Label}
+	graph = withoutOrderedRules(graph, seeds)
+	a := NewActivity(graph, seeds)
+	run := SimulateParallel(graph, len(graph), 1)
+	for i, node := range graph {
+		if step := activationStep(run, node.Label); step != a.steps[i] {
+			return fmt.Errorf("node %s has step %d, the activity %d", node.Label, step, a.steps[i])
+		}
+	}
+	return nil
+}
+
+// withoutOrderedRules returns a copy of the graph without the labels of the rules
+// activated at the step after a parent of the node, at the same level as the node.
+// Whether they are active when the parent reaches the node depends on the order the
+// nodes of the level are visited in, an Activity never counts them. Removing a label
+// can activate the node and change the steps after it, so labels are removed until
+// there are none left to remove.
+func withoutOrderedRules(graph []*LabelNode, seeds []string) []*LabelNode {
+	copied := make([]*LabelNode, len(graph))
+	for i, node := range graph {
+		n := *node
+		n.Rule = append([]string(nil), node.Rule...)
+		copied[i] = &n
+	}
+	a := NewActivity(copied, seeds)
+	for {
+		removed := false
+		for i, node := range copied {
+			var rule []string
+			for _, label := range node.Rule {
+				ordered := false
+				if r, ok := a.ids[label]; ok && a.steps[r] != unreached {
+					for _, p := range a.parents[i] {
+						if a.steps[p] != unreached && a.steps[r] == a.steps[p]+1 {
+							ordered = true
+						}
+					}
+				}
+				if ordered {
+					removed = true
+				} else {
+					rule = append(rule, label)
+				}
+			}
+			node.Rule = rule
+		}
+		if !removed {
+			return copied
+		}
+		a = NewActivity(copied, seeds)
+	}
+}
+
+// randomMutation returns a mutation that can be applied to the graph.
+func randomMutation(r *rand.Rand, graph []*LabelNode) Mutation {
+	randomRule := func() []string {
+		var rule []string
+		for j := r.Intn(3); j > 0; j-- {
+			rule = append(rule, graph[r.Intn(len(graph))].Label)
+		}
+		return rule
+	}
+	for {
+		switch op := r.Intn(4); {
+		case op == 0 || len(graph) < 2:
+			return Mutation{Op: AddNode, Label: uuid.NewV4().String(), Rule: randomRule()}
+		case op == 1:
+			m := Mutation{Op: AddEdge, Label: graph[r.Intn(len(graph))].Label, Target: graph[r.Intn(len(graph))].Label}
+			if _, err := m.Apply(graph); err == nil {
+				return m
+			}
+		case op == 2:
+			return Mutation{Op: RemoveNode, Label: graph[r.Intn(len(graph))].Label}
+		default:
+			return Mutation{Op: SetRule, Label: graph[r.Intn(len(graph))].Label, Rule: randomRule()}
+		}
+	}
+}
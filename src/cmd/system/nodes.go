@@ -1,37 +1,195 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// LabelNode is a node of the knowledge graph. Once a graph is loaded or generated
+// its nodes are never modified, all the state of a simulation is kept in a Run.
+// Id is the position of the node in the graph and Children the positions of its
+// children, see fileNode for how they can be written in graph files.
 type LabelNode struct {
-	Id       int      `json:id`
-	Label    string   `json:label`
-	Rule     []string `json:rule,omitempty`
-	Children []int    `json:children`
-	Visited  bool
+	Id       int      `json:"Id"`
+	Label    string   `json:"Label"`
+	Rule     []string `json:"Rule,omitempty"`
+	Children []int    `json:"Children"`
 }
 
 func load(inputFile string) []*LabelNode {
-	data, err := ioutil.ReadFile(inputFile)
+	graph, err := readGraph(inputFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return graph
+}
+
+// writeGraph writes the graph to outputFile, with the children given by position or
+// by label. The file is written atomically, readers either see the previous file or
+// the complete graph. An existing file is only replaced if force is set.
+func writeGraph(graph []*LabelNode, outputFile string, byLabel, force bool) error {
+	b, err := marshalGraph(graph, byLabel)
+	if err != nil {
+		return err
+	}
+	if force {
+		return writeFileAtomic(outputFile, b, 0644)
+	}
+	return writeFileNoClobber(outputFile, b, 0644)
+}
 
-	var nodes []*LabelNode
-	err = json.Unmarshal(data, &nodes)
+// outputGraph writes the graph to the path given by the output flag of the command,
+// with the children given by label if the labels flag is set.
+func outputGraph(c *cli.Context, graph []*LabelNode, vars map[string]string) {
+	b, err := marshalGraph(graph, c.Bool("labels"))
 	if err != nil {
 		log.Fatal(err)
 	}
-	return nodes
+	outputFile := writeOutput(c, b, vars)
+	fmt.Printf("Graph written to %s\n", outputFile)
 }
 
-func output(graph []*LabelNode, outputFile string) {
-	b, err := json.MarshalIndent(graph, "", "  ")
+// writeOutput writes data to the path given by the output flag of the command and
+// returns the path. The path is expanded with outputPath, vars are the values of
+// the placeholders known to the command in addition to {command} and {timestamp}.
+// An existing file is only replaced if the force flag is set.
+func writeOutput(c *cli.Context, data []byte, vars map[string]string) string {
+	return writeOutputFlag(c, "output", data, vars)
+}
+
+// writeOutputFlag is writeOutput for the path given by another flag.
+func writeOutputFlag(c *cli.Context, flag string, data []byte, vars map[string]string) string {
+	if vars == nil {
+		vars = make(map[string]string)
+	}
+	vars["command"] = c.Command.Name
+	vars["timestamp"] = time.Now().Format(timestampFormat)
+	outputFile, err := outputPath(c.String(flag), vars)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if c.Bool("force") {
+		err = writeFileAtomic(outputFile, data, 0644)
+	} else {
+		err = writeFileNoClobber(outputFile, data, 0644)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	ioutil.WriteFile(outputFile, b, 0777)
+	return outputFile
+}
+
+const timestampFormat = "20060102T150405"
+
+// outputUsage documents the placeholders expanded by outputPath for the output flags.
+const outputUsage = "Placeholders {command}, {size}, {seed} (generated graphs only) and {timestamp} are replaced by their values. An existing file is not replaced unless force is set."
+
+// outputPath expands the placeholders of an output path template such as
+// ./data/{command}-{size}-{seed}.json. It fails on unknown placeholders and on
+// placeholders without a value for this run, rather than creating a file with
+// braces in its name.
+func outputPath(template string, vars map[string]string) (string, error) {
+	var path []byte
+	for i := 0; i < len(template); i++ {
+		if template[i] != '{' {
+			path = append(path, template[i])
+			continue
+		}
+		end := strings.IndexByte(template[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("output path %q: unterminated placeholder", template)
+		}
+		name := template[i+1 : i+end]
+		switch name {
+		case "command", "size", "seed", "timestamp":
+		default:
+			return "", fmt.Errorf("output path %q: unknown placeholder {%s}", template, name)
+		}
+		value, ok := vars[name]
+		if !ok {
+			return "", fmt.Errorf("output path %q: {%s} is not known for this run", template, name)
+		}
+		path = append(path, value...)
+		i += end
+	}
+	return string(path), nil
+}
+
+// writeFileAtomic writes data to a temporary file next to name and renames it over
+// name once synced, so name never contains a partially written file.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir syncs a directory so that the files created or renamed in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFileNoClobber writes data to name like writeFileAtomic but fails if name
+// already exists. The complete temporary file is linked to name, which fails
+// atomically if name exists.
+func writeFileNoClobber(name string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(name)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(name)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Link(f.Name(), name)
+	}
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists, use --force to replace it", name)
+	}
+	if err != nil {
+		return err
+	}
+	return syncDir(dir)
 }
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// bitmap is a set of node ids that can be read and added to by any number of
+// goroutines at once.
+type bitmap []uint32
+
+func newBitmap(size int) bitmap {
+	return make(bitmap, (size+31)/32)
+}
+
+func (b bitmap) get(i int) bool {
+	return atomic.LoadUint32(&b[i/32])&(1<<uint(i%32)) != 0
+}
+
+// set adds i to the set and returns true if it was not already in it. When several
+// goroutines set the same i at once, exactly one of them gets true.
+func (b bitmap) set(i int) bool {
+	word, mask := &b[i/32], uint32(1)<<uint(i%32)
+	for {
+		old := atomic.LoadUint32(word)
+		if old&mask != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint32(word, old, old|mask) {
+			return true
+		}
+	}
+}
+
+// task is a node to expand, with the step at which it was activated.
+type task struct {
+	id   int
+	step int
+}
+
+// deque holds the tasks of a worker. The worker pushes at the bottom and pops from the
+// top, expanding the nodes in the order they were activated so that, as in the test
+// simulation, the nodes of a step are usually active before the rules of the next
+// step are checked. Other workers steal from the bottom, away from the owner.
+type deque struct {
+	mutex sync.Mutex
+	tasks []task
+	// Keeps the deques of the workers on separate cache lines.
+	_ [64]byte
+}
+
+func (d *deque) push(t task) {
+	d.mutex.Lock()
+	d.tasks = append(d.tasks, t)
+	d.mutex.Unlock()
+}
+
+func (d *deque) pop() (task, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if len(d.tasks) == 0 {
+		return task{}, false
+	}
+	t := d.tasks[0]
+	d.tasks = d.tasks[1:]
+	return t, true
+}
+
+// steal moves half of the tasks of d, at least one, from its bottom to the bottom of
+// to and returns true if there were any.
+func (d *deque) steal(to *deque) bool {
+	d.mutex.Lock()
+	n := (len(d.tasks) + 1) / 2
+	stolen := append([]task(nil), d.tasks[len(d.tasks)-n:]...)
+	d.tasks = d.tasks[:len(d.tasks)-n]
+	d.mutex.Unlock()
+	if n == 0 {
+		return false
+	}
+	to.mutex.Lock()
+	to.tasks = append(to.tasks, stolen...)
+	to.mutex.Unlock()
+	return true
+}
+
+// SimulateParallel runs the test simulation over the graph from its first node with
+// workers goroutines and no central collector. Each worker expands the nodes of its
+// own deque and steals from the others when it runs out. A child is activated by the
+// worker that first finds its rule satisfied and sets it in the visited bitmap, so no
+// lock is taken on the way. Like the concurrent simulation, the steps and the nodes
+// activated depend on the order in which the workers happen to reach them.
+func SimulateParallel(graph []*LabelNode, depth, workers int) *Run {
+	if workers < 1 {
+		workers = 1
+	}
+	index := make(map[string]int, len(graph))
+	for i, node := range graph {
+		index[node.Label] = i
+	}
+	// The rules by id, with -1 for the labels that are not in the graph.
+	rules := make([][]int, len(graph))
+	for i, node := range graph {
+		for _, label := range node.Rule {
+			r, ok := index[label]
+			if !ok {
+				r = -1
+			}
+			rules[i] = append(rules[i], r)
+		}
+	}
+
+	visited := newBitmap(len(graph))
+	satisfied := func(i int) bool {
+		for _, r := range rules[i] {
+			if r < 0 || !visited.get(r) {
+				return false
+			}
+		}
+		return true
+	}
+
+	deques := make([]deque, workers)
+	activations := make([][]Activation, workers)
+	// pending counts the tasks pushed but not expanded yet, the simulation is over when
+	// it drops to 0.
+	pending := int64(1)
+	visited.set(0)
+	activations[0] = append(activations[0], Activation{Id: 0, Label: graph[0].Label, Step: 0})
+	deques[0].push(task{id: 0, step: 0})
+
+	var waitGroup sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		waitGroup.Add(1)
+		go func(w int) {
+			defer waitGroup.Done()
+			own := &deques[w]
+			victim := w
+			for {
+				t, ok := own.pop()
+				if !ok {
+					if atomic.LoadInt64(&pending) == 0 {
+						return
+					}
+					for n := 1; n < workers && !ok; n++ {
+						victim = (victim + 1) % workers
+						if victim != w && deques[victim].steal(own) {
+							t, ok = own.pop()
+						}
+					}
+					if !ok {
+						runtime.Gosched()
+						continue
+					}
+				}
+
+				if t.step < depth {
+					for _, childId := range graph[t.id].Children {
+						if !visited.get(childId) && satisfied(childId) && visited.set(childId) {
+							activations[w] = append(activations[w], Activation{Id: childId, Label: graph[childId].Label, Step: t.step + 1})
+							atomic.AddInt64(&pending, 1)
+							own.push(task{id: childId, step: t.step + 1})
+						}
+					}
+				}
+				atomic.AddInt64(&pending, -1)
+			}
+		}(w)
+	}
+	waitGroup.Wait()
+
+	run := NewRun(graph)
+	for _, worker := range activations {
+		for _, a := range worker {
+			run.Activate(graph[a.Id], a.Step)
+		}
+	}
+	return run
+}
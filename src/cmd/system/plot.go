@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"strconv"
+)
+
+// Plot is a line chart of series of points, written as SVG by the report command.
+type Plot struct {
+	Title  string
+	XLabel string
+	YLabel string
+	// LogX and LogY use a logarithmic scale on the axis, its values must be positive.
+	LogX   bool
+	LogY   bool
+	Series []Series
+}
+
+type Series struct {
+	Name   string
+	Points []Point
+}
+
+type Point struct {
+	X, Y float64
+}
+
+// plotColors are the colors of the series, in order.
+var plotColors = []string{"#1f77b4", "#d62728", "#2ca02c", "#ff7f0e", "#9467bd", "#8c564b", "#e377c2", "#7f7f7f"}
+
+const (
+	plotWidth  = 480
+	plotHeight = 320
+	// Margins around the area of the points, for the title, ticks, labels and legend.
+	plotLeft   = 70
+	plotRight  = 130
+	plotTop    = 30
+	plotBottom = 50
+)
+
+// axis maps the values of an axis to a length in pixels.
+type axis struct {
+	min, max float64
+	log      bool
+	length   float64
+}
+
+func newAxis(values []float64, log bool, length float64) axis {
+	a := axis{min: math.Inf(1), max: math.Inf(-1), log: log, length: length}
+	if len(values) == 0 {
+		a.min, a.max = 0, 1
+		return a
+	}
+	for _, v := range values {
+		if log {
+			v = math.Log10(v)
+		}
+		a.min = math.Min(a.min, v)
+		a.max = math.Max(a.max, v)
+	}
+	if log {
+		a.min, a.max = math.Floor(a.min), math.Ceil(a.max)
+	} else {
+		step := niceStep(a.max - a.min)
+		a.min, a.max = math.Floor(a.min/step)*step, math.Ceil(a.max/step)*step
+	}
+	if a.max <= a.min {
+		a.max = a.min + 1
+	}
+	return a
+}
+
+func (a axis) scale(v float64) float64 {
+	if a.log {
+		v = math.Log10(v)
+	}
+	return (v - a.min) / (a.max - a.min) * a.length
+}
+
+// ticks returns the values to mark on the axis: the powers of 10 on a logarithmic
+// scale and multiples of a round step otherwise.
+func (a axis) ticks() []float64 {
+	var ticks []float64
+	if a.log {
+		for e := a.min; e <= a.max; e++ {
+			ticks = append(ticks, math.Pow(10, e))
+		}
+		return ticks
+	}
+	step := niceStep(a.max - a.min)
+	for v := a.min; v <= a.max+step/2; v += step {
+		ticks = append(ticks, v)
+	}
+	return ticks
+}
+
+// niceStep returns a step of 1, 2 or 5 times a power of 10 dividing span in about 5.
+func niceStep(span float64) float64 {
+	if span <= 0 {
+		return 1
+	}
+	step := math.Pow(10, math.Floor(math.Log10(span/5)))
+	for _, m := range []float64{1, 2, 5, 10} {
+		if span/(step*m) <= 6 {
+			return step * m
+		}
+	}
+	return step * 10
+}
+
+func formatTick(v float64) string {
+	if v != 0 && (math.Abs(v) >= 1e5 || math.Abs(v) < 1e-3) {
+		return strconv.FormatFloat(v, 'e', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', 4, 64)
+}
+
+// SVG writes the plot as a standalone SVG document.
+func (p *Plot) SVG() []byte {
+	var xs, ys []float64
+	for _, s := range p.Series {
+		for _, pt := range s.Points {
+			xs = append(xs, pt.X)
+			ys = append(ys, pt.Y)
+		}
+	}
+	w, h := float64(plotWidth-plotLeft-plotRight), float64(plotHeight-plotTop-plotBottom)
+	x, y := newAxis(xs, p.LogX, w), newAxis(ys, p.LogY, h)
+	px := func(v float64) float64 { return plotLeft + x.scale(v) }
+	py := func(v float64) float64 { return plotTop + h - y.scale(v) }
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif" font-size="11">`+"\n",
+		plotWidth, plotHeight, plotWidth, plotHeight)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d" fill="white"/>`+"\n", plotWidth, plotHeight)
+	fmt.Fprintf(&buf, `<text x="%d" y="18" text-anchor="middle" font-size="13">%s</text>`+"\n",
+		plotLeft+int(w)/2, html.EscapeString(p.Title))
+
+	for _, t := range x.ticks() {
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", px(t), plotTop, px(t), plotTop+h)
+		fmt.Fprintf(&buf, `<text x="%.1f" y="%.1f" text-anchor="middle">%s</text>`+"\n", px(t), plotTop+h+15, formatTick(t))
+	}
+	for _, t := range y.ticks() {
+		fmt.Fprintf(&buf, `<line x1="%d" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`+"\n", plotLeft, py(t), plotLeft+w, py(t))
+		fmt.Fprintf(&buf, `<text x="%d" y="%.1f" text-anchor="end">%s</text>`+"\n", plotLeft-5, py(t)+4, formatTick(t))
+	}
+	fmt.Fprintf(&buf, `<rect x="%d" y="%d" width="%.1f" height="%.1f" fill="none" stroke="black"/>`+"\n", plotLeft, plotTop, w, h)
+	fmt.Fprintf(&buf, `<text x="%.1f" y="%d" text-anchor="middle">%s</text>`+"\n",
+		plotLeft+w/2, plotHeight-12, html.EscapeString(p.XLabel))
+	fmt.Fprintf(&buf, `<text transform="translate(16 %.1f) rotate(-90)" text-anchor="middle">%s</text>`+"\n",
+		plotTop+h/2, html.EscapeString(p.YLabel))
+
+	for i, s := range p.Series {
+		color := plotColors[i%len(plotColors)]
+		var points bytes.Buffer
+		for _, pt := range s.Points {
+			fmt.Fprintf(&points, "%.1f,%.1f ", px(pt.X), py(pt.Y))
+			fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="2.5" fill="%s"/>`+"\n", px(pt.X), py(pt.Y), color)
+		}
+		fmt.Fprintf(&buf, `<polyline points="%s" fill="none" stroke="%s" stroke-width="1.5"/>`+"\n",
+			bytes.TrimSpace(points.Bytes()), color)
+		ly := plotTop + 10 + 16*i
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%d" x2="%.1f" y2="%d" stroke="%s" stroke-width="1.5"/>`+"\n",
+			plotLeft+w+10, ly, plotLeft+w+30, ly, color)
+		fmt.Fprintf(&buf, `<text x="%.1f" y="%d">%s</text>`+"\n", plotLeft+w+35, ly+4, html.EscapeString(s.Name))
+	}
+	buf.WriteString("</svg>\n")
+	return buf.Bytes()
+}
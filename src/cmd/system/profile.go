@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+)
+
+// profileFlags are the profiling flags of the commands running simulations.
+var profileFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "cpuprofile",
+		Usage: "Write a CPU profile of the simulation to the file, for go tool pprof.",
+	},
+	cli.StringFlag{
+		Name:  "memprofile",
+		Usage: "Write a profile of the memory allocated by the simulation to the file, for go tool pprof.",
+	},
+	cli.StringFlag{
+		Name:  "blockprofile",
+		Usage: "Write a profile of where the goroutines of the simulation blocked to the file, for go tool pprof.",
+	},
+	cli.StringFlag{
+		Name:  "mutexprofile",
+		Usage: "Write a profile of the contention on the mutexes of the simulation to the file, for go tool pprof.",
+	},
+	cli.StringFlag{
+		Name:  "trace",
+		Usage: "Write an execution trace of the simulation to the file, for go tool trace.",
+	},
+}
+
+// profiles are the profiles of the timed section of a simulation, from start to stop,
+// so that they do not include loading the graph and writing the output.
+type profiles struct {
+	cpu, mem, block, mutex, trace *os.File
+}
+
+// newProfiles creates the files of the profiling flags set, before the setup so that
+// a bad path fails early. Sampling of the allocations is turned off until start.
+func newProfiles(c *cli.Context) *profiles {
+	p := new(profiles)
+	for _, f := range []struct {
+		flag string
+		file **os.File
+	}{
+		{"cpuprofile", &p.cpu},
+		{"memprofile", &p.mem},
+		{"blockprofile", &p.block},
+		{"mutexprofile", &p.mutex},
+		{"trace", &p.trace},
+	} {
+		if !c.IsSet(f.flag) {
+			continue
+		}
+		file, err := os.Create(c.String(f.flag))
+		if err != nil {
+			log.Fatal(err)
+		}
+		*f.file = file
+	}
+	if p.mem != nil {
+		runtime.MemProfileRate = 0
+	}
+	return p
+}
+
+func (p *profiles) start() {
+	if p.block != nil {
+		runtime.SetBlockProfileRate(1)
+	}
+	if p.mutex != nil {
+		runtime.SetMutexProfileFraction(1)
+	}
+	if p.cpu != nil {
+		if err := pprof.StartCPUProfile(p.cpu); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if p.trace != nil {
+		if err := trace.Start(p.trace); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if p.mem != nil {
+		runtime.MemProfileRate = 512 * 1024
+	}
+}
+
+// stop ends the profiles in the reverse order of start and writes them.
+func (p *profiles) stop() {
+	if p.mem != nil {
+		runtime.MemProfileRate = 0
+	}
+	if p.trace != nil {
+		trace.Stop()
+	}
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+	}
+	if p.mutex != nil {
+		runtime.SetMutexProfileFraction(0)
+	}
+	if p.block != nil {
+		runtime.SetBlockProfileRate(0)
+	}
+	if p.mem != nil {
+		// The profile of the allocations is as of the last garbage collection.
+		runtime.GC()
+	}
+
+	for _, f := range []struct {
+		file    *os.File
+		profile string
+	}{
+		{p.mem, "allocs"},
+		{p.block, "block"},
+		{p.mutex, "mutex"},
+	} {
+		if f.file == nil {
+			continue
+		}
+		if err := pprof.Lookup(f.profile).WriteTo(f.file, 0); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, file := range []*os.File{p.cpu, p.mem, p.block, p.mutex, p.trace} {
+		if file == nil {
+			continue
+		}
+		if err := file.Close(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Profile written to %s\n", file.Name())
+	}
+}
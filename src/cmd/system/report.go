@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readResults reads the result files given and the result files found under the
+// directories given. In directories, the files that are not results, such as the
+// graphs of an experiment, are skipped.
+func readResults(paths []string) ([]*Result, error) {
+	var results []*Result
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			r, err := readResult(path)
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, r)
+			continue
+		}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() || filepath.Ext(file) != ".json" {
+				return err
+			}
+			if r, err := readResult(file); err == nil && r.Fingerprint != "" {
+				results = append(results, r)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// reportKey is a configuration of an engine on a graph. The results of the same
+// configuration on the same graph are averaged.
+type reportKey struct {
+	Engine      string
+	Fingerprint string
+	Size        int
+	Depth       int
+	Workers     int
+	BufferSize  int
+	BatchSize   int
+}
+
+type reportEntry struct {
+	key     reportKey
+	runs    int
+	elapsed time.Duration
+	actives int
+}
+
+func (e *reportEntry) mean() time.Duration {
+	return e.elapsed / time.Duration(e.runs)
+}
+
+// Report summarizes result files into the tables and plots of the paper.
+type Report struct {
+	entries map[reportKey]*reportEntry
+}
+
+func NewReport(results []*Result) *Report {
+	r := &Report{entries: make(map[reportKey]*reportEntry)}
+	for _, result := range results {
+		engine := result.Engine
+		if engine == "test" {
+			engine = "sequential"
+		}
+		key := reportKey{engine, result.Fingerprint, result.Size, result.Depth, result.Workers, result.BufferSize, result.BatchSize}
+		e, ok := r.entries[key]
+		if !ok {
+			e = &reportEntry{key: key}
+			r.entries[key] = e
+		}
+		e.runs++
+		e.elapsed += result.Elapsed
+		e.actives += len(result.Actives)
+	}
+	return r
+}
+
+// engines returns the engines of the results, the sequential engine first.
+func (r *Report) engines() []string {
+	seen := make(map[string]bool)
+	var names []string
+	for key := range r.entries {
+		if !seen[key.Engine] {
+			seen[key.Engine] = true
+			names = append(names, key.Engine)
+		}
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		if name == "sequential" {
+			copy(names[1:i+1], names[:i])
+			names[0] = name
+		}
+	}
+	return names
+}
+
+func (r *Report) sizes() []int {
+	return r.values(func(k reportKey) (int, bool) { return k.Size, true })
+}
+
+// values returns the distinct values of a field of the keys selected, in order.
+func (r *Report) values(field func(reportKey) (int, bool)) []int {
+	seen := make(map[int]bool)
+	var values []int
+	for key := range r.entries {
+		if v, ok := field(key); ok && !seen[v] {
+			seen[v] = true
+			values = append(values, v)
+		}
+	}
+	sort.Ints(values)
+	return values
+}
+
+// depth is the depth the runtimes are compared at, the largest of the results.
+func (r *Report) depth() int {
+	depths := r.values(func(k reportKey) (int, bool) { return k.Depth, true })
+	if len(depths) == 0 {
+		return 0
+	}
+	return depths[len(depths)-1]
+}
+
+// best returns the fastest configuration of the engine on the graphs of the size at
+// the depth matching the filter, or nil if there is none. The runtime of a
+// configuration is the mean over the graphs of its mean runtime on each graph, so
+// each graph counts the same however many times it was run.
+func (r *Report) best(engine string, size, depth int, filter func(reportKey) bool) *reportEntry {
+	configs := make(map[reportKey]*reportEntry)
+	for key, e := range r.entries {
+		if key.Engine != engine || key.Size != size || key.Depth != depth || filter != nil && !filter(key) {
+			continue
+		}
+		config := key
+		config.Fingerprint = ""
+		c, ok := configs[config]
+		if !ok {
+			c = &reportEntry{key: config}
+			configs[config] = c
+		}
+		c.runs++
+		c.elapsed += e.mean()
+	}
+	var best *reportEntry
+	for _, c := range configs {
+		if best == nil || c.mean() < best.mean() || c.mean() == best.mean() && reportKeyLess(c.key, best.key) {
+			best = c
+		}
+	}
+	return best
+}
+
+// reportKeyLess orders the configurations of an engine, so ties are broken the same
+// way on every run.
+func reportKeyLess(a, b reportKey) bool {
+	if a.Workers != b.Workers {
+		return a.Workers < b.Workers
+	}
+	if a.BufferSize != b.BufferSize {
+		return a.BufferSize < b.BufferSize
+	}
+	return a.BatchSize < b.BatchSize
+}
+
+func engineTitle(engine string) string {
+	return strings.ToUpper(engine[:1]) + engine[1:]
+}
+
+// RuntimeTable writes a LaTeX tabular of the mean runtime of the fastest
+// configuration of each engine on each size, in seconds, to be \input in a table.
+func (r *Report) RuntimeTable(runs int) []byte {
+	engines := r.engines()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%% Generated by the report command from %d result files, do not edit.\n", runs)
+	fmt.Fprintf(&buf, "\\begin{tabular}{|c||%s|}\n\\hline\nNodes", strings.TrimSuffix(strings.Repeat("c|", len(engines)), "|"))
+	for _, engine := range engines {
+		fmt.Fprintf(&buf, " & %s (Runtime in seconds)", engineTitle(engine))
+	}
+	buf.WriteString("\\\\\n\\hline\n")
+	depth := r.depth()
+	for _, size := range r.sizes() {
+		buf.WriteString(strconv.Itoa(size))
+		for _, engine := range engines {
+			if e := r.best(engine, size, depth, nil); e != nil {
+				fmt.Fprintf(&buf, " & %s", strconv.FormatFloat(e.mean().Seconds(), 'f', -1, 64))
+			} else {
+				buf.WriteString(" & --")
+			}
+		}
+		buf.WriteString("\\\\\n\\hline\n")
+	}
+	buf.WriteString("\\end{tabular}\n")
+	return buf.Bytes()
+}
+
+// RuntimePlot plots the mean runtime of the fastest configuration of each engine
+// against the size of the graph.
+func (r *Report) RuntimePlot() *Plot {
+	p := &Plot{Title: "Runtime vs size", XLabel: "Nodes", YLabel: "Runtime (s)", LogX: true, LogY: true}
+	depth := r.depth()
+	for _, engine := range r.engines() {
+		s := Series{Name: engine}
+		for _, size := range r.sizes() {
+			if e := r.best(engine, size, depth, nil); e != nil {
+				s.Points = append(s.Points, Point{float64(size), e.mean().Seconds()})
+			}
+		}
+		p.Series = append(p.Series, s)
+	}
+	return p
+}
+
+// SpeedupPlot plots the speedup of the engines using workers on the largest graph
+// against their number of routines. The speedup is over the sequential engine, or
+// over the fewest routines if there is no result of the sequential engine.
+func (r *Report) SpeedupPlot() *Plot {
+	p := &Plot{Title: "Speedup vs routines", XLabel: "Routines", YLabel: "Speedup over sequential"}
+	sizes := r.sizes()
+	if len(sizes) == 0 {
+		return p
+	}
+	size, depth := sizes[len(sizes)-1], r.depth()
+	p.Title += fmt.Sprintf(" (%d nodes)", size)
+	sequential := r.best("sequential", size, depth, nil)
+	if sequential == nil {
+		p.YLabel = "Speedup over fewest routines"
+	}
+	for _, engine := range r.engines() {
+		if e, ok := engines[engine]; !ok || !e.Uses("workers") {
+			continue
+		}
+		routines := r.values(func(k reportKey) (int, bool) {
+			return k.Workers, k.Engine == engine && k.Size == size && k.Depth == depth
+		})
+		s := Series{Name: engine}
+		baseline := sequential
+		for _, workers := range routines {
+			w := workers
+			e := r.best(engine, size, depth, func(k reportKey) bool { return k.Workers == w })
+			if baseline == nil {
+				baseline = e
+			}
+			s.Points = append(s.Points, Point{float64(workers), float64(baseline.mean()) / float64(e.mean())})
+		}
+		p.Series = append(p.Series, s)
+	}
+	return p
+}
+
+// ActivesPlot plots the mean number of active nodes of each engine on the largest
+// graph against the depth.
+func (r *Report) ActivesPlot() *Plot {
+	p := &Plot{Title: "Actives vs depth", XLabel: "Depth", YLabel: "Active nodes"}
+	sizes := r.sizes()
+	if len(sizes) == 0 {
+		return p
+	}
+	size := sizes[len(sizes)-1]
+	p.Title += fmt.Sprintf(" (%d nodes)", size)
+	for _, engine := range r.engines() {
+		s := Series{Name: engine}
+		depths := r.values(func(k reportKey) (int, bool) { return k.Depth, k.Engine == engine && k.Size == size })
+		for _, depth := range depths {
+			runs, actives := 0, 0
+			for key, e := range r.entries {
+				if key.Engine == engine && key.Size == size && key.Depth == depth {
+					runs += e.runs
+					actives += e.actives
+				}
+			}
+			s.Points = append(s.Points, Point{float64(depth), float64(actives) / float64(runs)})
+		}
+		p.Series = append(p.Series, s)
+	}
+	return p
+}
+
+func ReportCommand(c *cli.Context) {
+	if len(c.Args()) == 0 {
+		log.Fatal("report: give result files or directories")
+	}
+	results, err := readResults(c.Args())
+	if err != nil {
+		log.Fatalf("report: %v", err)
+	}
+	if len(results) == 0 {
+		log.Fatal("report: no results found")
+	}
+	r := NewReport(results)
+
+	dir := c.String("dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		log.Fatal(err)
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{"runtime.tex", r.RuntimeTable(len(results))},
+		{"runtime-size.svg", r.RuntimePlot().SVG()},
+		{"speedup-routines.svg", r.SpeedupPlot().SVG()},
+		{"actives-depth.svg", r.ActivesPlot().SVG()},
+	}
+	fmt.Printf("Results: %d\nEngines: %s\nSizes: %d\nDepth: %d\n", len(results), strings.Join(r.engines(), ", "), len(r.sizes()), r.depth())
+	for _, f := range files {
+		file := filepath.Join(dir, f.name)
+		if err := writeFileAtomic(file, f.data, 0644); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Written to %s\n", file)
+	}
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"github.com/codegangsta/cli"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SeedSet is a set of seeds that activates a target, with the rule gated nodes whose
+// rules are satisfied on the way to it.
+type SeedSet struct {
+	Seeds []string
+	Rules []string
+}
+
+// seedQuery chains backward from a target to the sets of seeds that may activate it:
+// a node is active within depth d if it is a seed, or if one of its parents and every
+// label of its rule are active within depth d-1. This ignores that the rule is only
+// checked when the parent reaches the node, so a seed can activate the parent too
+// early, and each set found is repaired against the closure of the graph.
+type seedQuery struct {
+	activity *Activity
+	target   int
+	limit    int
+	memo     map[[2]int][][]int
+	// ancestors are the nodes the target can be reached from, itself included.
+	ancestors map[int]bool
+}
+
+// RequiredSeeds returns up to limit minimal sets of seeds that activate the target
+// within depth, smallest first. The target itself is never one of the seeds. A set is
+// minimal if none of its seeds can be removed without the target being activated too
+// late or never, and no smaller set found activates it.
+func RequiredSeeds(graph []*LabelNode, target string, depth, limit int) ([]SeedSet, error) {
+	return requiredSeeds(NewActivity(graph, nil), target, nil, depth, limit)
+}
+
+// requiredSeeds returns up to limit minimal sets of seeds to add to the given seeds
+// for the target to be activated within depth.
+func requiredSeeds(a *Activity, target string, seeds []string, depth, limit int) ([]SeedSet, error) {
+	t, ok := a.ids[target]
+	if !ok {
+		return nil, fmt.Errorf("unknown target %q", target)
+	}
+	base := make(map[int]bool)
+	for _, seed := range seeds {
+		i, ok := a.ids[seed]
+		if !ok {
+			return nil, fmt.Errorf("unknown seed %q", seed)
+		}
+		base[i] = true
+	}
+	q := &seedQuery{activity: a, target: t, limit: limit, memo: make(map[[2]int][][]int), ancestors: map[int]bool{t: true}}
+	for queue := []int{t}; len(queue) > 0; queue = queue[1:] {
+		for _, p := range a.parents[queue[0]] {
+			if !q.ancestors[p] {
+				q.ancestors[p] = true
+				queue = append(queue, p)
+			}
+		}
+	}
+
+	var sets [][]int
+	for _, set := range q.sets(t, depth) {
+		var extra []int
+		for _, i := range set {
+			if !base[i] {
+				extra = append(extra, i)
+			}
+		}
+		if extra, ok := q.repair(seeds, extra, depth); ok {
+			sets = append(sets, q.shrink(seeds, extra, depth))
+		}
+	}
+	sets = minimalSets(sets, limit)
+
+	var results []SeedSet
+	for _, set := range sets {
+		result := SeedSet{Seeds: a.labels(set)}
+		steps := Closure(a.Graph, append(append([]string(nil), seeds...), result.Seeds...))
+		for _, i := range derivation(a, steps, t) {
+			if steps[i] > 0 && len(a.Graph[i].Rule) > 0 {
+				result.Rules = append(result.Rules, a.Graph[i].Label)
+			}
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// sets returns the minimal sets of node ids that activate node i within depth, as
+// far as limit allows.
+func (q *seedQuery) sets(i, depth int) [][]int {
+	if depth < 0 {
+		return nil
+	}
+	key := [2]int{i, depth}
+	if sets, ok := q.memo[key]; ok {
+		return sets
+	}
+
+	var sets [][]int
+	if i != q.target {
+		sets = append(sets, []int{i})
+	}
+	var premises [][]int
+	for n, label := range q.activity.Graph[i].Rule {
+		r, ok := q.activity.ids[label]
+		if !ok {
+			premises = nil
+			break
+		}
+		if n == 0 {
+			premises = q.sets(r, depth-1)
+		} else {
+			premises = q.product(premises, q.sets(r, depth-1))
+		}
+		if len(premises) == 0 {
+			break
+		}
+	}
+	if len(q.activity.Graph[i].Rule) == 0 || len(premises) > 0 {
+		for _, p := range q.activity.parents[i] {
+			parentSets := q.sets(p, depth-1)
+			if len(q.activity.Graph[i].Rule) > 0 {
+				parentSets = q.product(parentSets, premises)
+			}
+			sets = append(sets, parentSets...)
+		}
+	}
+
+	sets = minimalSets(sets, q.limit)
+	q.memo[key] = sets
+	return sets
+}
+
+// product returns the minimal unions of a set of a and a set of b.
+func (q *seedQuery) product(a, b [][]int) [][]int {
+	var sets [][]int
+	for _, x := range a {
+		for _, y := range b {
+			sets = append(sets, unionIds(x, y))
+		}
+	}
+	return minimalSets(sets, q.limit)
+}
+
+// activates checks if the target is activated within depth from the given seeds and
+// the seeds of set.
+func (q *seedQuery) activates(seeds []string, set []int, depth int) bool {
+	steps := Closure(q.activity.Graph, append(append([]string(nil), seeds...), q.activity.labels(set)...))
+	return steps[q.target] != unreached && steps[q.target] <= depth
+}
+
+// repair adds seeds to set until the target is activated within depth with the given
+// seeds: the labels of the rules of the target and its ancestors that are activated
+// after their parents reach them. It returns false if the target is still not
+// activated once no such label is left.
+func (q *seedQuery) repair(seeds []string, set []int, depth int) ([]int, bool) {
+	for {
+		a := NewActivity(q.activity.Graph, append(append([]string(nil), seeds...), q.activity.labels(set)...))
+		if step := a.steps[q.target]; step != unreached && step <= depth {
+			return set, true
+		}
+		added := false
+		for _, d := range AnalyzeDead(a, -1) {
+			if (d.Reason == RuleTooLate || d.Reason == RuleSameStep) && q.ancestors[a.ids[d.Label]] {
+				n := len(set)
+				set = unionIds(set, []int{a.ids[d.Cause]})
+				added = added || len(set) > n
+			}
+		}
+		if !added {
+			return nil, false
+		}
+	}
+}
+
+// shrink removes the seeds of set that are not needed, with the given seeds, for the
+// target to be activated within depth. A seed can delay a node by activating a parent
+// before the labels of its rule, so the set left is only minimal in that no single
+// seed can be removed from it.
+func (q *seedQuery) shrink(seeds []string, set []int, depth int) []int {
+	for n := 0; n < len(set); {
+		rest := append(append([]int(nil), set[:n]...), set[n+1:]...)
+		if q.activates(seeds, rest, depth) {
+			set = rest
+		} else {
+			n++
+		}
+	}
+	return set
+}
+
+// derivation returns the nodes the activation of node i depends on in steps: the
+// node itself, then for each node activated after the seeds, the parent reaching it
+// at the step before and the labels of its rule.
+func derivation(a *Activity, steps []int, i int) []int {
+	seen := map[int]bool{i: true}
+	nodes := []int{i}
+	for n := 0; n < len(nodes); n++ {
+		j := nodes[n]
+		if steps[j] <= 0 {
+			continue
+		}
+		parent := -1
+		for _, p := range a.parents[j] {
+			if steps[p] == steps[j]-1 {
+				parent = p
+				break
+			}
+		}
+		deps := []int{parent}
+		for _, label := range a.Graph[j].Rule {
+			deps = append(deps, a.ids[label])
+		}
+		for _, d := range deps {
+			if !seen[d] {
+				seen[d] = true
+				nodes = append(nodes, d)
+			}
+		}
+	}
+	return nodes
+}
+
+func (a *Activity) labels(ids []int) []string {
+	labels := make([]string, len(ids))
+	for n, i := range ids {
+		labels[n] = a.Graph[i].Label
+	}
+	return labels
+}
+
+// unionIds returns the union of two sorted sets of ids.
+func unionIds(a, b []int) []int {
+	union := make([]int, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			union, a = append(union, a[0]), a[1:]
+		case a[0] > b[0]:
+			union, b = append(union, b[0]), b[1:]
+		default:
+			union, a, b = append(union, a[0]), a[1:], b[1:]
+		}
+	}
+	union = append(union, a...)
+	return append(union, b...)
+}
+
+// subsetIds checks if the sorted set a is a subset of the sorted set b.
+func subsetIds(a, b []int) bool {
+	for len(a) > 0 && len(b) > 0 {
+		switch {
+		case a[0] < b[0]:
+			return false
+		case a[0] > b[0]:
+			b = b[1:]
+		default:
+			a, b = a[1:], b[1:]
+		}
+	}
+	return len(a) == 0
+}
+
+// minimalSets sorts the sets smallest first, drops the ones containing another and
+// keeps the first limit.
+func minimalSets(sets [][]int, limit int) [][]int {
+	for _, set := range sets {
+		sort.Ints(set)
+	}
+	sort.Sort(bySize(sets))
+	var minimal [][]int
+	for _, set := range sets {
+		redundant := false
+		for _, m := range minimal {
+			if subsetIds(m, set) {
+				redundant = true
+				break
+			}
+		}
+		if !redundant {
+			minimal = append(minimal, set)
+			if len(minimal) == limit {
+				break
+			}
+		}
+	}
+	return minimal
+}
+
+type bySize [][]int
+
+func (a bySize) Len() int      { return len(a) }
+func (a bySize) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a bySize) Less(i, j int) bool {
+	if len(a[i]) != len(a[j]) {
+		return len(a[i]) < len(a[j])
+	}
+	for n := range a[i] {
+		if a[i][n] != a[j][n] {
+			return a[i][n] < a[j][n]
+		}
+	}
+	return false
+}
+
+func printSeedSets(a *Activity, sets []SeedSet) {
+	for n, set := range sets {
+		fmt.Printf("%d: %s\n", n+1, strings.Join(set.Seeds, ", "))
+		for _, label := range set.Rules {
+			fmt.Printf("  %s requires %s\n", label, strings.Join(a.Graph[a.ids[label]].Rule, " & "))
+		}
+	}
+}
+
+func RequiresQuery(c *cli.Context) {
+	graph := load(c.String("input"))
+	if _, err := NewLabelIndex(graph); err != nil {
+		log.Fatal(err)
+	}
+	a := NewActivity(graph, nil)
+	target := c.String("target")
+	sets, err := requiredSeeds(a, target, nil, c.Int("depth"), c.Int("limit"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(sets) == 0 {
+		fmt.Printf("No seeds activate %s within depth %d\n", target, c.Int("depth"))
+		return
+	}
+	fmt.Printf("Seeds activating %s within depth %d:\n", target, c.Int("depth"))
+	printSeedSets(a, sets)
+}
+
+func WhyNotQuery(c *cli.Context) {
+	graph := load(c.String("input"))
+	if _, err := NewLabelIndex(graph); err != nil {
+		log.Fatal(err)
+	}
+	seeds := c.StringSlice("seed")
+	if len(seeds) == 0 && len(graph) > 0 {
+		seeds = []string{graph[0].Label}
+	}
+	a := NewActivity(graph, seeds)
+	target, depth := c.String("target"), c.Int("depth")
+	t, ok := a.ids[target]
+	if !ok {
+		log.Fatalf("why-not: unknown target %q", target)
+	}
+
+	step := a.steps[t]
+	if step != unreached && step <= depth {
+		fmt.Printf("%s is active at step %d:\n", target, step)
+		for _, i := range derivation(a, a.steps, t) {
+			node := a.Graph[i]
+			fmt.Printf("  %s at step %d", node.Label, a.steps[i])
+			if len(node.Rule) > 0 {
+				fmt.Printf(", rule %s", strings.Join(node.Rule, " & "))
+			}
+			fmt.Println()
+		}
+		return
+	}
+	if step == unreached {
+		fmt.Printf("%s is never active\n", target)
+		byLabel := make(map[string]DeadNode)
+		for _, d := range AnalyzeDead(a, -1) {
+			byLabel[d.Label] = d
+		}
+		fmt.Printf("  %s\n", byLabel[target])
+		printReasons(os.Stdout, byLabel[target], byLabel)
+	} else {
+		fmt.Printf("%s is active at step %d, after depth %d\n", target, step, depth)
+	}
+
+	sets, err := requiredSeeds(a, target, seeds, depth, c.Int("limit"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(sets) == 0 {
+		fmt.Printf("No seeds added activate %s within depth %d\n", target, depth)
+		return
+	}
+	fmt.Printf("Seeds to add to activate %s within depth %d:\n", target, depth)
+	printSeedSets(a, sets)
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequiredSeedsRuleTooLate(t *testing.T) {
+	graph, err := compileDSL("testdata/dead.kg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sets, err := RequiredSeeds(graph, "late", 10, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// c alone reaches late before e is active, e has to be a seed too.
+	want := []SeedSet{{Seeds: []string{"a", "e"}}, {Seeds: []string{"c", "e"}}}
+	for i := range sets {
+		sets[i].Rules = nil
+	}
+	if !reflect.DeepEqual(sets, want) {
+		t.Errorf("seed sets %v, want %v", sets, want)
+	}
+}
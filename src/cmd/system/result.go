@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Result is the outcome of a simulation as written to a result file, with what is
+// needed to tell which graph and settings produced it.
+type Result struct {
+	// Fingerprint is the hash of the graph the simulation ran over, see GraphHash.
+	Fingerprint string
+	// Input is the graph file, empty for a generated graph.
+	Input  string `json:",omitempty"`
+	Size   int
+	Engine string
+	Seeds  []string
+	Depth  int
+	// Workers, BufferSize and BatchSize are the options of the engine, if it uses them.
+	Workers    int `json:",omitempty"`
+	BufferSize int `json:",omitempty"`
+	BatchSize  int `json:",omitempty"`
+
+	// Actives are the active nodes ordered by step then label.
+	Actives []Activation
+
+	Start time.Time
+	// Elapsed is the time taken by the simulation in nanoseconds, excluding setup.
+	Elapsed time.Duration
+}
+
+func NewResult(graph []*LabelNode, run *Run, engine string, seeds []string, depth int, start time.Time, elapsed time.Duration) *Result {
+	r := &Result{
+		Fingerprint: GraphHash(graph),
+		Size:        len(graph),
+		Engine:      engine,
+		Seeds:       seeds,
+		Depth:       depth,
+		Actives:     append([]Activation(nil), run.Trace...),
+		Start:       start,
+		Elapsed:     elapsed,
+	}
+	sort.Sort(byStepLabel(r.Actives))
+	return r
+}
+
+type byStepLabel []Activation
+
+func (a byStepLabel) Len() int      { return len(a) }
+func (a byStepLabel) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byStepLabel) Less(i, j int) bool {
+	if a[i].Step != a[j].Step {
+		return a[i].Step < a[j].Step
+	}
+	return a[i].Label < a[j].Label
+}
+
+func readResult(file string) (*Result, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Result)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return r, nil
+}
+
+// outputResult writes the result to the path given by the result flag.
+func outputResult(c *cli.Context, result *Result, vars map[string]string) {
+	b, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	resultFile := writeOutputFlag(c, "result", b, vars)
+	fmt.Printf("Result written to %s\n", resultFile)
+}
+
+// Run rebuilds the run of the result over the graph. If graph is nil, the run is
+// over a graph of the active nodes only, without edges.
+func (r *Result) Run(graph []*LabelNode) (*Run, error) {
+	if graph == nil {
+		for i, a := range r.Actives {
+			graph = append(graph, &LabelNode{Id: i, Label: a.Label, Children: []int{}})
+		}
+	}
+	index, err := NewLabelIndex(graph)
+	if err != nil {
+		return nil, err
+	}
+	run := NewRun(graph)
+	for _, a := range r.Actives {
+		i, ok := index[a.Label]
+		if !ok {
+			return nil, fmt.Errorf("active node %q is not in the graph", a.Label)
+		}
+		run.Activate(graph[i], a.Step)
+	}
+	return run, nil
+}
+
+// Verify checks the result against the graph and returns the problems found: a
+// different fingerprint, active nodes that are not in the graph, seeds that are not
+// active at step 0, steps after the depth, and nodes without a parent active at an
+// earlier step or with an inactive label in their rule. For an engine with ClosureSteps
+// the active nodes and their steps must be exactly the ones computed by Closure.
+//
+// A node is activated one step after a parent, at the earliest. How the steps of the
+// rule and the depth are checked depends on the Steps of the engine.
+func (r *Result) Verify(graph []*LabelNode) []string {
+	var problems []string
+	if fingerprint := GraphHash(graph); fingerprint != r.Fingerprint {
+		problems = append(problems, fmt.Sprintf("hash of the graph is %s, not %s", fingerprint, r.Fingerprint))
+	}
+	engine, err := lookupEngine(r.Engine)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	run, err := r.Run(graph)
+	if err != nil {
+		return append(problems, err.Error())
+	}
+
+	parents := make([][]*LabelNode, len(graph))
+	for _, node := range graph {
+		for _, childId := range node.Children {
+			parents[childId] = append(parents[childId], node)
+		}
+	}
+	seeds := make(map[string]bool)
+	for _, seed := range r.Seeds {
+		seeds[seed] = true
+		if step := activationStep(run, seed); step != 0 {
+			problems = append(problems, fmt.Sprintf("seed %s is not active at step 0", seed))
+		}
+	}
+	steps := engine.Steps()
+	for _, a := range r.Actives {
+		node := run.Actives[a.Label]
+		if a.Step > r.Depth && steps != PassSteps {
+			problems = append(problems, fmt.Sprintf("%s is active at step %d, after depth %d", a.Label, a.Step, r.Depth))
+		}
+		if seeds[a.Label] {
+			continue
+		}
+		justified := false
+		for _, p := range parents[node.Id] {
+			if step := activationStep(run, p.Label); step != unreached && step <= a.Step-1 {
+				justified = true
+				break
+			}
+		}
+		if !justified {
+			problems = append(problems, fmt.Sprintf("%s is active at step %d without a parent active by step %d", a.Label, a.Step, a.Step-1))
+		}
+		for _, label := range node.Rule {
+			step := activationStep(run, label)
+			switch {
+			case step == unreached:
+				problems = append(problems, fmt.Sprintf("%s is active but its rule requires %s, which is not", a.Label, label))
+			case steps == ClosureSteps && step > a.Step-1:
+				problems = append(problems, fmt.Sprintf("%s is active at step %d but its rule requires %s, active at step %d", a.Label, a.Step, label, step))
+			}
+		}
+	}
+
+	if steps == ClosureSteps {
+		expected := NewActivity(graph, r.Seeds).Run(r.Depth)
+		d := DiffRuns(expected, run)
+		for _, change := range append(append(d.Gained, d.Lost...), d.Changed...) {
+			problems = append(problems, fmt.Sprintf("%s is active at step %d, the closure activates it at step %d",
+				change.Label, change.Steps[1], change.Steps[0]))
+		}
+	}
+	return problems
+}
+
+func printResult(r *Result, actives bool) {
+	fmt.Printf("Fingerprint: %s\n", r.Fingerprint)
+	if r.Input != "" {
+		fmt.Printf("Input: %s\n", r.Input)
+	}
+	fmt.Printf("Graph Size: %d\nEngine: %s\nSeeds: %v\nDepth: %d\n", r.Size, r.Engine, r.Seeds, r.Depth)
+	fmt.Printf("Start: %s\nTime taken: %s\nNum actives: %d\n", r.Start.Format(time.RFC3339), r.Elapsed, len(r.Actives))
+	if actives {
+		for _, a := range r.Actives {
+			fmt.Printf("  %d %s\n", a.Step, a.Label)
+		}
+	}
+}
+
+func PrintResult(c *cli.Context) {
+	r, err := readResult(c.String("input"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	printResult(r, c.Bool("actives"))
+}
+
+func DiffResults(c *cli.Context) {
+	inputs := c.StringSlice("input")
+	graphs := c.StringSlice("graph")
+	if len(inputs) != 2 {
+		log.Fatal("result diff: give two result files")
+	}
+	if len(graphs) > 2 {
+		log.Fatal("result diff: give at most two graph files")
+	}
+	if len(graphs) == 1 {
+		graphs = append(graphs, graphs[0])
+	}
+
+	var sides [2]diffSide
+	for n := range sides {
+		r, err := readResult(inputs[n])
+		if err != nil {
+			log.Fatal(err)
+		}
+		var graph []*LabelNode
+		if len(graphs) > 0 {
+			graph = load(graphs[n])
+			if GraphHash(graph) != r.Fingerprint {
+				log.Fatalf("result diff: %s was not produced from %s", inputs[n], graphs[n])
+			}
+		}
+		run, err := r.Run(graph)
+		if err != nil {
+			log.Fatalf("%s: %v", inputs[n], err)
+		}
+		sides[n] = diffSide{Name: fmt.Sprintf("%s (%s)", inputs[n], r.Engine), Run: run}
+	}
+	if printDiff(sides[0], sides[1], len(graphs) > 0) && c.Bool("exit-code") {
+		os.Exit(1)
+	}
+}
+
+func VerifyResult(c *cli.Context) {
+	r, err := readResult(c.String("input"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	graph := load(c.String("graph"))
+	problems := r.Verify(graph)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	fmt.Printf("Num actives: %d\nProblems: %d\n", len(r.Actives), len(problems))
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+// Activation records a node becoming active during a run and the step at which it
+// happened. The seed nodes are activated at step 0 and the children of a node
+// activated at step n are activated at step n+1.
+type Activation struct {
+	Id    int
+	Label string
+	Step  int
+}
+
+// Run holds the state of a single simulation over a graph. The graph is only read
+// so any number of runs can share the same graph, sequentially or concurrently,
+// without having to reset it between runs.
+// A Run itself is not safe for concurrent use, engines running goroutines must
+// confine the mutations of a run to a single goroutine.
+type Run struct {
+	Graph   []*LabelNode
+	Actives map[string]*LabelNode
+	Trace   []Activation
+
+	visited []bool
+	steps   []int
+}
+
+func NewRun(graph []*LabelNode) *Run {
+	return &Run{
+		Graph:   graph,
+		Actives: make(map[string]*LabelNode),
+		visited: make([]bool, len(graph)),
+		steps:   make([]int, len(graph)),
+	}
+}
+
+// Visit marks the node as visited and returns true if it had not been visited
+// before in this run.
+func (r *Run) Visit(node *LabelNode) bool {
+	if r.visited[node.Id] {
+		return false
+	}
+	r.visited[node.Id] = true
+	return true
+}
+
+func (r *Run) Visited(node *LabelNode) bool {
+	return r.visited[node.Id]
+}
+
+// Activate adds the node to the actives and records it in the trace. Activating a
+// node that is already active does nothing.
+func (r *Run) Activate(node *LabelNode, step int) {
+	if _, ok := r.Actives[node.Label]; ok {
+		return
+	}
+	r.Actives[node.Label] = node
+	r.steps[node.Id] = step
+	r.Trace = append(r.Trace, Activation{Id: node.Id, Label: node.Label, Step: step})
+}
+
+// Step returns the step at which an active node was activated.
+func (r *Run) Step(node *LabelNode) int {
+	return r.steps[node.Id]
+}
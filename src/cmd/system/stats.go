@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"unsafe"
+)
+
+// Histogram counts values, such as the degrees of the nodes.
+type Histogram map[int]int
+
+func (h Histogram) keys() []int {
+	var keys []int
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// Distribution summarizes a list of values.
+type Distribution struct {
+	Min       int
+	Max       int
+	Mean      float64
+	Histogram Histogram
+}
+
+func newDistribution(values []int) Distribution {
+	d := Distribution{Histogram: make(Histogram)}
+	if len(values) == 0 {
+		return d
+	}
+	d.Min, d.Max = values[0], values[0]
+	total := 0
+	for _, v := range values {
+		if v < d.Min {
+			d.Min = v
+		}
+		if v > d.Max {
+			d.Max = v
+		}
+		total += v
+		d.Histogram[v]++
+	}
+	d.Mean = float64(total) / float64(len(values))
+	return d
+}
+
+// GraphStats describes a graph to help size simulation runs before launching them.
+type GraphStats struct {
+	Hash      string
+	Nodes     int
+	Edges     int
+	OutDegree Distribution
+	InDegree  Distribution
+
+	// Seeds are the labels the depth is measured from, Reachable the number of nodes
+	// reachable from them by edges and Depth the number of nodes at each depth.
+	Seeds     []string
+	Reachable int
+	MaxDepth  int
+	Depth     Histogram
+
+	Components        int
+	CyclicComponents  int
+	LargestComponent  int
+	RuleGated         int
+	RuleGatedFraction float64
+	RuleArity         Histogram
+
+	// Rules referencing labels that are not in the graph can never be satisfied and
+	// rules referencing their own node can only be satisfied if the node is a seed.
+	UnsatisfiableRules []string
+	SelfReferencing    []string
+
+	// GraphBytes estimates the memory used by the loaded graph and RunBytes the
+	// memory used by the state of a run activating every node.
+	GraphBytes int64
+	RunBytes   int64
+}
+
+func computeStats(graph []*LabelNode, seeds []string) (*GraphStats, error) {
+	index, err := NewLabelIndex(graph)
+	if err != nil {
+		return nil, err
+	}
+	s := &GraphStats{
+		Hash:      GraphHash(graph),
+		Nodes:     len(graph),
+		Seeds:     seeds,
+		Depth:     make(Histogram),
+		RuleArity: make(Histogram),
+	}
+
+	outDegrees := make([]int, len(graph))
+	inDegrees := make([]int, len(graph))
+	for i, node := range graph {
+		outDegrees[i] = len(node.Children)
+		s.Edges += len(node.Children)
+		for _, childId := range node.Children {
+			inDegrees[childId]++
+		}
+		if node.Rule != nil {
+			s.RuleGated++
+			s.RuleArity[len(node.Rule)]++
+		}
+		for _, label := range node.Rule {
+			if _, ok := index[label]; !ok {
+				s.UnsatisfiableRules = append(s.UnsatisfiableRules, node.Label)
+				break
+			}
+		}
+		for _, label := range node.Rule {
+			if label == node.Label {
+				s.SelfReferencing = append(s.SelfReferencing, node.Label)
+				break
+			}
+		}
+	}
+	s.OutDegree = newDistribution(outDegrees)
+	s.InDegree = newDistribution(inDegrees)
+	if len(graph) > 0 {
+		s.RuleGatedFraction = float64(s.RuleGated) / float64(len(graph))
+	}
+
+	depth := make([]int, len(graph))
+	for i := range depth {
+		depth[i] = -1
+	}
+	var queue []int
+	for _, seed := range seeds {
+		i, ok := index[seed]
+		if !ok {
+			return nil, fmt.Errorf("stats: unknown seed %q", seed)
+		}
+		if depth[i] < 0 {
+			depth[i] = 0
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		s.Reachable++
+		s.Depth[depth[i]]++
+		if depth[i] > s.MaxDepth {
+			s.MaxDepth = depth[i]
+		}
+		for _, childId := range graph[i].Children {
+			if depth[childId] < 0 {
+				depth[childId] = depth[i] + 1
+				queue = append(queue, childId)
+			}
+		}
+	}
+
+	for _, component := range stronglyConnectedComponents(graph) {
+		s.Components++
+		if len(component) > s.LargestComponent {
+			s.LargestComponent = len(component)
+		}
+		if len(component) > 1 || hasSelfLoop(graph[component[0]]) {
+			s.CyclicComponents++
+		}
+	}
+
+	s.GraphBytes, s.RunBytes = estimateMemory(graph)
+	return s, nil
+}
+
+func hasSelfLoop(node *LabelNode) bool {
+	for _, childId := range node.Children {
+		if childId == node.Id {
+			return true
+		}
+	}
+	return false
+}
+
+// stronglyConnectedComponents returns the strongly connected components of the graph
+// using Tarjan's algorithm. It is iterative since graphs can be deeper than the stack
+// of a goroutine can recurse.
+func stronglyConnectedComponents(graph []*LabelNode) [][]int {
+	const unvisited = -1
+	index := make([]int, len(graph))
+	lowlink := make([]int, len(graph))
+	onStack := make([]bool, len(graph))
+	for i := range index {
+		index[i] = unvisited
+	}
+	var stack []int
+	var components [][]int
+	next := 0
+
+	type frame struct {
+		node  int
+		child int
+	}
+	for root := range graph {
+		if index[root] != unvisited {
+			continue
+		}
+		calls := []frame{{node: root}}
+		index[root], lowlink[root] = next, next
+		next++
+		stack = append(stack, root)
+		onStack[root] = true
+
+		for len(calls) > 0 {
+			f := &calls[len(calls)-1]
+			children := graph[f.node].Children
+			if f.child < len(children) {
+				childId := children[f.child]
+				f.child++
+				if index[childId] == unvisited {
+					index[childId], lowlink[childId] = next, next
+					next++
+					stack = append(stack, childId)
+					onStack[childId] = true
+					calls = append(calls, frame{node: childId})
+				} else if onStack[childId] && index[childId] < lowlink[f.node] {
+					lowlink[f.node] = index[childId]
+				}
+				continue
+			}
+
+			node := f.node
+			calls = calls[:len(calls)-1]
+			if len(calls) > 0 {
+				parent := calls[len(calls)-1].node
+				if lowlink[node] < lowlink[parent] {
+					lowlink[parent] = lowlink[node]
+				}
+			}
+			if lowlink[node] == index[node] {
+				var component []int
+				for {
+					top := stack[len(stack)-1]
+					stack = stack[:len(stack)-1]
+					onStack[top] = false
+					component = append(component, top)
+					if top == node {
+						break
+					}
+				}
+				components = append(components, component)
+			}
+		}
+	}
+	return components
+}
+
+// estimateMemory estimates the bytes used by a graph and by the state of a run, from
+// the sizes of the structures and the lengths of the strings and slices they hold.
+func estimateMemory(graph []*LabelNode) (graphBytes, runBytes int64) {
+	const (
+		pointerSize      = int64(unsafe.Sizeof(uintptr(0)))
+		stringSize       = int64(unsafe.Sizeof(""))
+		intSize          = int64(unsafe.Sizeof(0))
+		mapEntryOverhead = 2 * pointerSize
+	)
+	nodeSize := int64(unsafe.Sizeof(LabelNode{}))
+
+	graphBytes = int64(len(graph)) * pointerSize
+	for _, node := range graph {
+		graphBytes += nodeSize + int64(len(node.Label))
+		graphBytes += int64(cap(node.Children)) * intSize
+		graphBytes += int64(cap(node.Rule)) * stringSize
+		for _, label := range node.Rule {
+			graphBytes += int64(len(label))
+		}
+	}
+
+	// The visited flags and steps of a Run, and its actives map and trace if every
+	// node is activated.
+	activation := int64(unsafe.Sizeof(Activation{}))
+	n := int64(len(graph))
+	runBytes = n*(1+intSize) + n*(stringSize+pointerSize+mapEntryOverhead) + n*activation
+	return graphBytes, runBytes
+}
+
+func printHistogram(w io.Writer, name string, h Histogram) {
+	fmt.Fprintf(w, "%s:\n", name)
+	for _, k := range h.keys() {
+		fmt.Fprintf(w, "  %d: %d\n", k, h[k])
+	}
+}
+
+func printStats(w io.Writer, s *GraphStats) {
+	fmt.Fprintf(w, "Graph Hash: %s\nNodes: %d\nEdges: %d\n", s.Hash, s.Nodes, s.Edges)
+	fmt.Fprintf(w, "Out degree: min %d, mean %.2f, max %d\n", s.OutDegree.Min, s.OutDegree.Mean, s.OutDegree.Max)
+	fmt.Fprintf(w, "In degree: min %d, mean %.2f, max %d\n", s.InDegree.Min, s.InDegree.Mean, s.InDegree.Max)
+	printHistogram(w, "Out degree distribution", s.OutDegree.Histogram)
+	printHistogram(w, "In degree distribution", s.InDegree.Histogram)
+	fmt.Fprintf(w, "Reachable from seeds: %d\nMax depth: %d\n", s.Reachable, s.MaxDepth)
+	printHistogram(w, "Nodes by depth", s.Depth)
+	fmt.Fprintf(w, "Strongly connected components: %d\nCyclic components: %d\nLargest component: %d\n",
+		s.Components, s.CyclicComponents, s.LargestComponent)
+	fmt.Fprintf(w, "Rule gated nodes: %d (%.2f%%)\n", s.RuleGated, 100*s.RuleGatedFraction)
+	printHistogram(w, "Rule arity", s.RuleArity)
+	fmt.Fprintf(w, "Unsatisfiable rules: %d\n", len(s.UnsatisfiableRules))
+	for _, label := range s.UnsatisfiableRules {
+		fmt.Fprintf(w, "  %s\n", label)
+	}
+	fmt.Fprintf(w, "Self referencing rules: %d\n", len(s.SelfReferencing))
+	for _, label := range s.SelfReferencing {
+		fmt.Fprintf(w, "  %s\n", label)
+	}
+	fmt.Fprintf(w, "Estimated graph memory: %d bytes\nEstimated run memory: %d bytes\n", s.GraphBytes, s.RunBytes)
+}
+
+func GraphStatistics(c *cli.Context) {
+	graph := load(c.String("input"))
+	seeds := c.StringSlice("seed")
+	if len(seeds) == 0 && len(graph) > 0 {
+		seeds = []string{graph[0].Label}
+	}
+	s, err := computeStats(graph, seeds)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch c.String("format") {
+	case "text":
+		printStats(os.Stdout, s)
+	case "json":
+		b, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(string(b))
+	default:
+		log.Fatalf("stats: unknown format %q, use text or json", c.String("format"))
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/codegangsta/cli"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Store keeps a graph on disk as a snapshot in the graph file format and a write
+// ahead log of the mutations applied since the snapshot.
+//
+// Every record of the log is written as
+//
+//	length   uint32, little endian length of the payload
+//	checksum uint32, CRC-32 (IEEE) of the payload
+//	payload  json of a walRecord
+//
+// and synced before the mutation is applied to the graph in memory, so a mutation
+// returned without error survives a crash. A record whose write or sync fails is
+// truncated from the log, so the records after it are not lost behind it on replay.
+//
+// Snapshots are named after the sequence number of the last mutation they contain.
+// On open the latest snapshot is loaded and the records with a greater sequence
+// number are replayed. A record torn by a crash is detected by its length or
+// checksum and truncated, along with everything after it.
+type Store struct {
+	Dir   string
+	Graph []*LabelNode
+
+	// SnapshotEvery is the number of mutations after which a snapshot is taken and
+	// the log compacted. If 0, snapshots are only taken by calling Snapshot.
+	SnapshotEvery int
+
+	seq         uint64
+	snapshotSeq uint64
+	wal         *os.File
+	// broken is the error that left the log in an unknown state, after which the
+	// store refuses mutations until it is reopened.
+	broken error
+
+	// crash is used to simulate crashes. It is called before writing data at the
+	// given point and returns whether to crash and how many bytes of data are
+	// written before crashing.
+	crash func(point string, data []byte) (int, bool)
+	// fail is used to simulate failed writes the same way, the store is still used
+	// after them.
+	fail func(point string, data []byte) (int, bool)
+}
+
+const (
+	walFile        = "wal.log"
+	snapshotPrefix = "snapshot-"
+	snapshotSuffix = ".json"
+	tmpSuffix      = ".tmp"
+	walHeaderSize  = 8
+)
+
+// ErrCrashed is returned by a store when a simulated crash happened. The store must
+// not be used afterwards, it has to be reopened.
+var ErrCrashed = errors.New("store: simulated crash")
+
+// ErrWriteFailed is returned by a store when a simulated write failure happened.
+var ErrWriteFailed = errors.New("store: simulated write failure")
+
+// SnapshotError is returned by Apply when the mutation was logged and applied but the
+// snapshot due after it failed. The mutation is not lost, the log still holds it.
+type SnapshotError struct {
+	Err error
+}
+
+func (e *SnapshotError) Error() string {
+	return fmt.Sprintf("store: mutation applied but snapshot failed: %v", e.Err)
+}
+
+type walRecord struct {
+	Seq      uint64
+	Mutation Mutation
+}
+
+// InitStore creates a store in dir with graph as its first snapshot. dir must not
+// already contain a store.
+func InitStore(dir string, graph []*LabelNode) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	if len(snapshots) > 0 {
+		return fmt.Errorf("store: %s already contains a store", dir)
+	}
+	b, err := json.MarshalIndent(graph, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, snapshotName(0)), b, 0644)
+}
+
+// OpenStore recovers the graph of the store in dir from its latest snapshot and log.
+func OpenStore(dir string) (*Store, error) {
+	s := &Store{Dir: dir}
+
+	snapshots, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("store: no snapshot found in %s", dir)
+	}
+	s.snapshotSeq = snapshots[len(snapshots)-1]
+	s.seq = s.snapshotSeq
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotName(s.snapshotSeq)))
+	if err != nil {
+		return nil, err
+	}
+	if s.Graph, err = decodeGraph(data); err != nil {
+		return nil, fmt.Errorf("store: snapshot %d: %v", s.snapshotSeq, err)
+	}
+
+	s.wal, err = os.OpenFile(filepath.Join(dir, walFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.replay(); err != nil {
+		s.wal.Close()
+		return nil, err
+	}
+	// Snapshots older than the latest one and temporary files left by a crash are
+	// no longer needed.
+	if err := s.removeStale(); err != nil {
+		s.wal.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay applies the records of the log newer than the snapshot and truncates the
+// log after the last valid record.
+func (s *Store) replay() error {
+	r := bufio.NewReader(s.wal)
+	var offset int64
+	for {
+		record, n, err := readRecord(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("store: truncating %s at offset %d: %v", walFile, offset, err)
+			if err := s.wal.Truncate(offset); err != nil {
+				return err
+			}
+			if err := s.wal.Sync(); err != nil {
+				return err
+			}
+			break
+		}
+		offset += n
+		if record.Seq <= s.seq {
+			continue
+		}
+		graph, err := record.Mutation.Apply(s.Graph)
+		if err != nil {
+			return fmt.Errorf("store: replaying mutation %d: %v", record.Seq, err)
+		}
+		s.Graph = graph
+		s.seq = record.Seq
+	}
+	_, err := s.wal.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readRecord reads a record of the log and returns the number of bytes read. It returns
+// io.EOF only if the log ends cleanly before the record.
+func readRecord(r io.Reader) (walRecord, int64, error) {
+	var record walRecord
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(r, header)
+	if err == io.EOF {
+		return record, 0, io.EOF
+	}
+	if err != nil {
+		return record, 0, fmt.Errorf("torn record header (%d bytes)", n)
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	payload := make([]byte, length)
+	if n, err := io.ReadFull(r, payload); err != nil {
+		return record, 0, fmt.Errorf("torn record payload (%d of %d bytes)", n, length)
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return record, 0, errors.New("record checksum mismatch")
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return record, 0, err
+	}
+	return record, walHeaderSize + int64(length), nil
+}
+
+func encodeRecord(record walRecord) ([]byte, error) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, walHeaderSize, walHeaderSize+len(payload))
+	binary.LittleEndian.PutUint32(b[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(b[4:8], crc32.ChecksumIEEE(payload))
+	return append(b, payload...), nil
+}
+
+// Apply logs the mutation and applies it to the graph. Mutations that cannot be
+// applied to the graph are rejected without being logged. If a snapshot is due after
+// the mutation, its error is returned as a SnapshotError and the mutation stays
+// applied. If the record cannot be written and synced, it is truncated from the log,
+// and if that fails too the store is unusable until it is reopened.
+func (s *Store) Apply(m Mutation) error {
+	if s.broken != nil {
+		return fmt.Errorf("store: unusable after %v, it has to be reopened", s.broken)
+	}
+	graph, err := m.Apply(s.Graph)
+	if err != nil {
+		return err
+	}
+	b, err := encodeRecord(walRecord{Seq: s.seq + 1, Mutation: m})
+	if err != nil {
+		return err
+	}
+	offset, err := s.wal.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	err = s.write(walFile, s.wal, b)
+	if err == nil {
+		err = s.wal.Sync()
+	}
+	if err == ErrCrashed {
+		return err
+	}
+	if err != nil {
+		if rollbackErr := s.rollback(offset); rollbackErr != nil {
+			s.broken = err
+			return fmt.Errorf("%v, truncating %s: %v", err, walFile, rollbackErr)
+		}
+		return err
+	}
+	s.Graph = graph
+	s.seq++
+
+	if s.SnapshotEvery > 0 && s.seq-s.snapshotSeq >= uint64(s.SnapshotEvery) {
+		if err := s.Snapshot(); err != nil {
+			return &SnapshotError{err}
+		}
+	}
+	return nil
+}
+
+// Snapshot writes the graph as a new snapshot and compacts the log. A crash at any
+// point leaves either the old snapshot and the full log, or the new snapshot and a
+// log whose records are all older than it and skipped on replay.
+func (s *Store) Snapshot() error {
+	if s.seq == s.snapshotSeq {
+		return nil
+	}
+	b, err := json.MarshalIndent(s.Graph, "", "  ")
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(s.Dir, snapshotName(s.seq))
+	f, err := os.OpenFile(name+tmpSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := s.write("snapshot", f, b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(name+tmpSuffix, name); err != nil {
+		return err
+	}
+	if err := syncDir(s.Dir); err != nil {
+		return err
+	}
+	s.snapshotSeq = s.seq
+
+	if s.crash != nil {
+		if _, crashed := s.crash("compact", nil); crashed {
+			return ErrCrashed
+		}
+	}
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := s.wal.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	return s.removeStale()
+}
+
+// rollback truncates the log back to offset, removing a record partly written.
+func (s *Store) rollback(offset int64) error {
+	if err := s.wal.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := s.wal.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+func (s *Store) Close() error {
+	return s.wal.Close()
+}
+
+// write writes data to f unless a crash or a failure is simulated at this point.
+func (s *Store) write(point string, f *os.File, data []byte) error {
+	if s.crash != nil {
+		if n, crashed := s.crash(point, data); crashed {
+			f.Write(data[:n])
+			return ErrCrashed
+		}
+	}
+	if s.fail != nil {
+		if n, failed := s.fail(point, data); failed {
+			f.Write(data[:n])
+			return ErrWriteFailed
+		}
+	}
+	_, err := f.Write(data)
+	return err
+}
+
+func (s *Store) removeStale() error {
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		stale := strings.HasSuffix(name, tmpSuffix) || strings.HasPrefix(name, "."+snapshotPrefix)
+		if seq, ok := parseSnapshotName(name); ok && seq < s.snapshotSeq {
+			stale = true
+		}
+		if stale {
+			if err := os.Remove(filepath.Join(s.Dir, name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%020d%s", snapshotPrefix, seq, snapshotSuffix)
+}
+
+func parseSnapshotName(name string) (uint64, bool) {
+	if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+		return 0, false
+	}
+	var seq uint64
+	_, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), "%d", &seq)
+	return seq, err == nil
+}
+
+// listSnapshots returns the sequence numbers of the snapshots in dir in increasing
+// order.
+func listSnapshots(dir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []uint64
+	for _, file := range files {
+		if seq, ok := parseSnapshotName(file.Name()); ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Sort(uint64s(seqs))
+	return seqs, nil
+}
+
+type uint64s []uint64
+
+func (a uint64s) Len() int           { return len(a) }
+func (a uint64s) Less(i, j int) bool { return a[i] < a[j] }
+func (a uint64s) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+func openStore(c *cli.Context) *Store {
+	store, err := OpenStore(c.String("dir"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return store
+}
+
+func StoreInit(c *cli.Context) {
+	var graph []*LabelNode
+	if c.IsSet("input") {
+		graph = load(c.String("input"))
+	}
+	if err := InitStore(c.String("dir"), graph); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Store created in %s with %d nodes\n", c.String("dir"), len(graph))
+}
+
+func StoreSnapshot(c *cli.Context) {
+	store := openStore(c)
+	defer store.Close()
+	start := time.Now()
+	if err := store.Snapshot(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Snapshot: %d\nGraph Size: %d\nTime taken: %s\n", store.snapshotSeq, len(store.Graph), time.Since(start))
+}
+
+func StoreExport(c *cli.Context) {
+	store := openStore(c)
+	defer store.Close()
+	outputGraph(c, store.Graph, map[string]string{"size": strconv.Itoa(len(store.Graph))})
+}
+
+// storeCheck counts what happened during checkStore.
+type storeCheck struct {
+	// Crashes are the simulated crashes by point: the log, the snapshot or the
+	// compaction of the log.
+	Crashes   map[string]int
+	Failures  int
+	Mutations uint64
+}
+
+// checkStore initializes a store in the directory with the graph and applies random
+// mutations to it, simulating crashes at random points and failed writes of the log in
+// between. It checks after each recovery that the store contains exactly the mutations
+// that were acknowledged before the crash.
+func checkStore(dir string, expected []*LabelNode, r *rand.Rand, crashes, snapshot int) (*storeCheck, error) {
+	if err := InitStore(dir, expected); err != nil {
+		return nil, err
+	}
+	check := &storeCheck{Crashes: make(map[string]int)}
+	for n := 0; n < crashes; n++ {
+		store, err := OpenStore(dir)
+		if err != nil {
+			return check, err
+		}
+		if !sameGraph(store.Graph, expected) {
+			store.Close()
+			return check, fmt.Errorf("mismatch after recovery %d: the store does not contain the acknowledged mutations", n)
+		}
+		store.SnapshotEvery = snapshot
+
+		// Crash at a random point of one of the next writes.
+		countdown := r.Intn(2 * snapshot)
+		store.crash = func(point string, data []byte) (int, bool) {
+			if countdown--; countdown > 0 {
+				return 0, false
+			}
+			check.Crashes[point]++
+			if len(data) == 0 {
+				return 0, true
+			}
+			// A record fully written but not synced may or may not survive a
+			// crash, only torn records are simulated.
+			return r.Intn(len(data)), true
+		}
+		// The mutations after a failed write are acknowledged, its torn record must
+		// not hide them on recovery.
+		store.fail = func(point string, data []byte) (int, bool) {
+			if point != walFile || r.Intn(10) > 0 {
+				return 0, false
+			}
+			check.Failures++
+			return r.Intn(len(data)), true
+		}
+		for {
+			m := randomMutation(r, store.Graph)
+			seq := store.seq
+			err := store.Apply(m)
+			if snapshotErr, ok := err.(*SnapshotError); ok {
+				err = snapshotErr.Err
+			}
+			if err != nil && err != ErrCrashed && err != ErrWriteFailed {
+				store.Close()
+				return check, err
+			}
+			// A crash while taking a snapshot happens after the mutation is logged.
+			if store.seq > seq {
+				var applyErr error
+				if expected, applyErr = m.Apply(expected); applyErr != nil {
+					store.Close()
+					return check, applyErr
+				}
+			}
+			if err == ErrCrashed {
+				break
+			}
+		}
+		store.Close()
+	}
+
+	store, err := OpenStore(dir)
+	if err != nil {
+		return check, err
+	}
+	defer store.Close()
+	check.Mutations = store.seq
+	if !sameGraph(store.Graph, expected) {
+		return check, fmt.Errorf("mismatch after last recovery: the store does not contain the acknowledged mutations")
+	}
+	return check, nil
+}
+
+// CheckStore runs checkStore on a generated graph in a temporary directory.
+func CheckStore(c *cli.Context) {
+	seed := time.Now().UnixNano()
+	if c.IsSet("seed") {
+		seed = int64(c.Int("seed"))
+	}
+	dir, err := ioutil.TempDir("", "knowledge-store")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	graph := generateRandomTreeWithRules(4, c.Int("size"), seed)
+	fmt.Printf("Seed: %d\nGraph Size: %d\nCrashes: %d\n", seed, len(graph), c.Int("crashes"))
+
+	check, err := checkStore(dir, graph, rand.New(rand.NewSource(seed)), c.Int("crashes"), c.Int("snapshot"))
+	if err != nil {
+		fmt.Printf("Check failed: %v\n", err)
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+	fmt.Printf("Crashes in log: %d\nCrashes in snapshot: %d\nCrashes in compaction: %d\nFailed writes: %d\nMutations: %d\n",
+		check.Crashes[walFile], check.Crashes["snapshot"], check.Crashes["compact"], check.Failures, check.Mutations)
+}
+
+func sameGraph(a, b []*LabelNode) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !reflect.DeepEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreRecovery(t *testing.T) {
+	for seed := int64(1); seed <= 3; seed++ {
+		graph := generateRandomTreeWithRules(4, 100, seed)
+		if _, err := checkStore(t.TempDir(), graph, rand.New(rand.NewSource(seed)), 30, 10); err != nil {
+			t.Errorf("seed %d: %v", seed, err)
+		}
+	}
+}
+
+func TestStoreSnapshotError(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitStore(dir, []*LabelNode{{Id: 0, Label: "a"}}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.SnapshotEvery = 1
+	// The snapshot cannot be written over a directory.
+	if err := os.Mkdir(filepath.Join(dir, snapshotName(1)+tmpSuffix), 0755); err != nil {
+		t.Fatal(err)
+	}
+	err = store.Apply(Mutation{Op: AddNode, Label: "b"})
+	store.Close()
+	if _, ok := err.(*SnapshotError); !ok {
+		t.Fatalf("Apply returned %v, not a SnapshotError", err)
+	}
+
+	store, err = OpenStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if len(store.Graph) != 2 {
+		t.Errorf("the store has %d nodes after recovery, the mutation is lost", len(store.Graph))
+	}
+}
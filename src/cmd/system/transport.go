@@ -0,0 +1,145 @@
+package main
+
+import (
+	"mpmc"
+	"runtime"
+)
+
+// transport carries the batches of nodes between the collector and the workers of
+// the concurrent simulation. Both its ends wait until the simulation is over, when
+// done is closed.
+type transport interface {
+	// send sends the batch, waiting for room unless the simulation is over.
+	send(batch []task, done <-chan struct{})
+	// trySend sends the batch without waiting, or returns false if there is no room.
+	trySend(batch []task) bool
+	// receive returns the next batch, waiting for one, or false once the simulation
+	// is over.
+	receive(done <-chan struct{}) ([]task, bool)
+	// tryReceive returns the next batch without waiting, or false if there is none.
+	tryReceive() ([]task, bool)
+}
+
+// channelTransport is a buffered channel of batches.
+type channelTransport chan []task
+
+func newChannelTransport(bufferSize int) transport {
+	return make(channelTransport, bufferSize)
+}
+
+func (t channelTransport) send(batch []task, done <-chan struct{}) {
+	select {
+	case t <- batch:
+	case <-done:
+	}
+}
+
+func (t channelTransport) trySend(batch []task) bool {
+	select {
+	case t <- batch:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t channelTransport) receive(done <-chan struct{}) ([]task, bool) {
+	select {
+	case batch := <-t:
+		return batch, true
+	case <-done:
+		return nil, false
+	}
+}
+
+func (t channelTransport) tryReceive() ([]task, bool) {
+	select {
+	case batch := <-t:
+		return batch, true
+	default:
+		return nil, false
+	}
+}
+
+// ringTransport is a lock free queue of batches. As the queue cannot block, a
+// goroutine waiting on it yields to the others between attempts, so the idle workers
+// keep their processors busy.
+type ringTransport struct {
+	queue *mpmc.Queue
+}
+
+// newRingTransport makes a queue of the buffer size rounded up to a power of 2 of at
+// least 2, where a channel of buffer size 0 is unbuffered.
+func newRingTransport(bufferSize int) transport {
+	return ringTransport{mpmc.New(bufferSize)}
+}
+
+func (t ringTransport) send(batch []task, done <-chan struct{}) {
+	for !t.queue.Put(batch) {
+		select {
+		case <-done:
+			return
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+func (t ringTransport) trySend(batch []task) bool {
+	return t.queue.Put(batch)
+}
+
+func (t ringTransport) receive(done <-chan struct{}) ([]task, bool) {
+	for {
+		if batch, ok := t.tryReceive(); ok {
+			return batch, true
+		}
+		select {
+		case <-done:
+			return nil, false
+		default:
+			runtime.Gosched()
+		}
+	}
+}
+
+func (t ringTransport) tryReceive() ([]task, bool) {
+	batch, ok := t.queue.Get()
+	if !ok {
+		return nil, false
+	}
+	return batch.([]task), true
+}
+
+// sendOrReceive waits until the batch is sent to to or a batch is received from from,
+// whichever comes first, and returns the batch received and whether the batch was
+// sent instead, or false once the simulation is over. Two channels are waited on at
+// once, other transports are polled in turn, yielding between attempts.
+func sendOrReceive(to transport, batch []task, from transport, done <-chan struct{}) ([]task, bool, bool) {
+	if to, ok := to.(channelTransport); ok {
+		if from, ok := from.(channelTransport); ok {
+			select {
+			case to <- batch:
+				return nil, true, true
+			case received := <-from:
+				return received, false, true
+			case <-done:
+				return nil, false, false
+			}
+		}
+	}
+	for {
+		if to.trySend(batch) {
+			return nil, true, true
+		}
+		if received, ok := from.tryReceive(); ok {
+			return received, false, true
+		}
+		select {
+		case <-done:
+			return nil, false, false
+		default:
+			runtime.Gosched()
+		}
+	}
+}
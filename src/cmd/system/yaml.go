@@ -0,0 +1,262 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML used by experiment files into the values
+// encoding/json decodes to: map[string]interface{}, []interface{}, string, float64,
+// bool and nil. It supports block mappings and sequences nested by indentation with
+// spaces, flow sequences of scalars such as [1, 2, 4], plain, single and double quoted
+// scalars, and comments:
+//
+//	# a sweep over the engines
+//	engines: [sequential, concurrent]
+//	generators:
+//	  - type: rules
+//	    sizes: [1000, 10000]
+//
+// Anchors, tags, flow mappings, multi-line scalars and multiple documents are not
+// supported.
+func parseYAML(file string, data []byte) (interface{}, error) {
+	p := &yamlParser{file: file}
+	for n, text := range strings.Split(string(data), "\n") {
+		text = strings.TrimRight(stripYAMLComment(text), " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		line := yamlLine{n: n + 1, indent: len(text) - len(trimmed), text: trimmed}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, p.errorf(line, "indentation must be spaces")
+		}
+		p.lines = append(p.lines, line)
+	}
+	if len(p.lines) == 0 {
+		return nil, nil
+	}
+	v, err := p.block(p.lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(p.lines) {
+		return nil, p.errorf(p.lines[p.i], "unexpected indentation")
+	}
+	return v, nil
+}
+
+type yamlLine struct {
+	n      int
+	indent int
+	text   string
+}
+
+type yamlParser struct {
+	file  string
+	lines []yamlLine
+	i     int
+}
+
+func (p *yamlParser) errorf(line yamlLine, msg string) error {
+	return &SyntaxError{File: p.file, Line: line.n, Col: line.indent + 1, Msg: msg}
+}
+
+// block parses the mapping or sequence whose lines start at indent.
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if isYAMLItem(p.lines[p.i].text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func (p *yamlParser) sequence(indent int) (interface{}, error) {
+	items := []interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLItem(p.lines[p.i].text) {
+		line := p.lines[p.i]
+		item := strings.TrimLeft(strings.TrimPrefix(line.text, "-"), " ")
+		if item == "" {
+			p.i++
+			v, err := p.nested(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		if _, _, ok := splitYAMLKey(item); ok {
+			// The item is a mapping starting on the line of the dash, the line is
+			// parsed again as the first key of the mapping at the indent of the key.
+			p.lines[p.i] = yamlLine{n: line.n, indent: line.indent + len(line.text) - len(item), text: item}
+			v, err := p.mapping(p.lines[p.i].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+			continue
+		}
+		v, err := p.scalar(line, item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, v)
+		p.i++
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && !isYAMLItem(p.lines[p.i].text) {
+		line := p.lines[p.i]
+		key, value, ok := splitYAMLKey(line.text)
+		if !ok {
+			return nil, p.errorf(line, "expected key: value")
+		}
+		if _, dup := m[key]; dup {
+			return nil, p.errorf(line, "duplicate key "+strconv.Quote(key))
+		}
+		p.i++
+		if value == "" {
+			v, err := p.nested(indent, true)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = v
+			continue
+		}
+		v, err := p.scalar(line, value)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
+
+// nested parses the value of a key or item with nothing after it, on the lines
+// indented further than the key or item. A sequence can also be the value of a key
+// at the same indent. The value is nil if there is neither.
+func (p *yamlParser) nested(indent int, key bool) (interface{}, error) {
+	if p.i == len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.i]
+	if next.indent > indent || key && next.indent == indent && isYAMLItem(next.text) {
+		return p.block(next.indent)
+	}
+	return nil, nil
+}
+
+// scalar parses a scalar or a flow sequence of scalars.
+func (p *yamlParser) scalar(line yamlLine, s string) (interface{}, error) {
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, p.errorf(line, "unterminated flow sequence")
+		}
+		items := []interface{}{}
+		inner := strings.TrimSpace(s[1 : len(s)-1])
+		if inner == "" {
+			return items, nil
+		}
+		for _, item := range splitYAMLFlow(inner) {
+			v, err := p.scalar(line, strings.TrimSpace(item))
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, v)
+		}
+		return items, nil
+	}
+	switch {
+	case strings.HasPrefix(s, "{"):
+		return nil, p.errorf(line, "flow mappings are not supported")
+	case strings.HasPrefix(s, `"`):
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return nil, p.errorf(line, "bad double quoted string "+s)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, p.errorf(line, "bad single quoted string "+s)
+		}
+		return strings.Replace(s[1:len(s)-1], "''", "'", -1), nil
+	case s == "~" || s == "null":
+		return nil, nil
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}
+
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits a key: value line. The value is empty if the line ends with
+// the colon.
+func splitYAMLKey(text string) (string, string, bool) {
+	if strings.HasPrefix(text, `"`) || strings.HasPrefix(text, "'") || strings.HasPrefix(text, "[") {
+		return "", "", false
+	}
+	i := strings.Index(text, ": ")
+	if i < 0 {
+		if !strings.HasSuffix(text, ":") {
+			return "", "", false
+		}
+		i = len(text) - 1
+	}
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+}
+
+// splitYAMLFlow splits the items of a flow sequence on the commas outside quotes.
+func splitYAMLFlow(s string) []string {
+	var items []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quote != 0:
+			if s[i] == '\\' && quote == '"' {
+				i++
+			} else if s[i] == quote {
+				quote = 0
+			}
+		case s[i] == '"' || s[i] == '\'':
+			quote = s[i]
+		case s[i] == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// stripYAMLComment removes a comment, starting with a # at the start of the line or
+// after a space and outside quotes.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0:
+			if line[i] == '\\' && quote == '"' {
+				i++
+			} else if line[i] == quote {
+				quote = 0
+			}
+		case line[i] == '"' || line[i] == '\'':
+			if i == 0 || line[i-1] == ' ' || line[i-1] == '[' || line[i-1] == ',' || line[i-1] == '-' {
+				quote = line[i]
+			}
+		case line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
@@ -0,0 +1,113 @@
+// Package mpmc provides a bounded queue any number of goroutines can put to and get
+// from at once without taking a lock, an alternative to a buffered channel between
+// the goroutines of the concurrent engine.
+package mpmc
+
+import (
+	"sync/atomic"
+)
+
+// Queue is a bounded multi-producer multi-consumer FIFO queue on a ring buffer, after
+// the queue of Dmitry Vyukov. Each cell of the ring has a sequence number telling
+// whether it is free for the put at a position or full for the get at a position,
+// so a put or a get only takes a compare and swap of the position to claim its cell.
+// A put and a get never wait on each other, but a get of a cell waits for the put
+// claiming it to finish writing, the queue is not lock-free in the strict sense.
+//
+// Put and Get return immediately when the queue is full or empty, the caller decides
+// how to wait.
+type Queue struct {
+	// The positions of the next put and get, each on its own cache line as they are
+	// written by the producers and the consumers respectively.
+	_     [64]byte
+	tail  uint64
+	_     [56]byte
+	head  uint64
+	_     [56]byte
+	mask  uint64
+	cells []cell
+}
+
+type cell struct {
+	// seq is the position of the put the cell is free for, or that position plus 1 once
+	// the put has written the value, for the get at that position.
+	seq   uint64
+	value interface{}
+}
+
+// New returns a queue of at least capacity values, rounded up to a power of 2 of at
+// least 2.
+func New(capacity int) *Queue {
+	size := 2
+	for size < capacity {
+		size *= 2
+	}
+	q := &Queue{mask: uint64(size - 1), cells: make([]cell, size)}
+	for i := range q.cells {
+		q.cells[i].seq = uint64(i)
+	}
+	return q
+}
+
+// Put adds v at the tail of the queue, it returns false if the queue is full.
+func (q *Queue) Put(v interface{}) bool {
+	pos := atomic.LoadUint64(&q.tail)
+	for {
+		c := &q.cells[pos&q.mask]
+		seq := atomic.LoadUint64(&c.seq)
+		switch diff := int64(seq - pos); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&q.tail, pos, pos+1) {
+				c.value = v
+				atomic.StoreUint64(&c.seq, pos+1)
+				return true
+			}
+		case diff < 0:
+			// The cell still holds the value put a lap before.
+			return false
+		}
+		// Another producer claimed the position first.
+		pos = atomic.LoadUint64(&q.tail)
+	}
+}
+
+// Get removes the value at the head of the queue, it returns false if the queue is
+// empty.
+func (q *Queue) Get() (interface{}, bool) {
+	pos := atomic.LoadUint64(&q.head)
+	for {
+		c := &q.cells[pos&q.mask]
+		seq := atomic.LoadUint64(&c.seq)
+		switch diff := int64(seq - (pos + 1)); {
+		case diff == 0:
+			if atomic.CompareAndSwapUint64(&q.head, pos, pos+1) {
+				v := c.value
+				c.value = nil
+				// Frees the cell for the put a lap after.
+				atomic.StoreUint64(&c.seq, pos+q.mask+1)
+				return v, true
+			}
+		case diff < 0:
+			// The put of the position has not been made, or not finished.
+			return nil, false
+		}
+		// Another consumer claimed the position first.
+		pos = atomic.LoadUint64(&q.head)
+	}
+}
+
+// Len returns the number of values in the queue. It is only a hint while other
+// goroutines use the queue.
+func (q *Queue) Len() int {
+	head := atomic.LoadUint64(&q.head)
+	tail := atomic.LoadUint64(&q.tail)
+	if tail < head {
+		return 0
+	}
+	return int(tail - head)
+}
+
+// Cap returns the number of values the queue holds.
+func (q *Queue) Cap() int {
+	return len(q.cells)
+}